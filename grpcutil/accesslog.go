@@ -0,0 +1,123 @@
+package grpcutil
+
+//
+//Copyright 2019 Telenor Digital AS
+//
+//Licensed under the Apache License, Version 2.0 (the "License");
+//you may not use this file except in compliance with the License.
+//You may obtain a copy of the License at
+//
+//http://www.apache.org/licenses/LICENSE-2.0
+//
+//Unless required by applicable law or agreed to in writing, software
+//distributed under the License is distributed on an "AS IS" BASIS,
+//WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//See the License for the specific language governing permissions and
+//limitations under the License.
+//
+import (
+	"context"
+	"log"
+	"sync/atomic"
+	"time"
+
+	"github.com/lab5e/gotoolbox/rest"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/status"
+)
+
+// countingStream counts the messages sent and received on a stream
+type countingStream struct {
+	grpc.ServerStream
+	ctx      context.Context
+	received int64
+	sent     int64
+}
+
+func (c *countingStream) Context() context.Context {
+	return c.ctx
+}
+
+func (c *countingStream) RecvMsg(m interface{}) error {
+	err := c.ServerStream.RecvMsg(m)
+	if err == nil {
+		atomic.AddInt64(&c.received, 1)
+	}
+	return err
+}
+
+func (c *countingStream) SendMsg(m interface{}) error {
+	err := c.ServerStream.SendMsg(m)
+	if err == nil {
+		atomic.AddInt64(&c.sent, 1)
+	}
+	return err
+}
+
+// accessLogRecord returns the access log record for a call. The principal
+// and request ID are read from the context the handler was called with.
+func accessLogRecord(ctx, handlerCtx context.Context, method string, start time.Time, err error) rest.AccessLogRecord {
+	principal, _ := callPrincipal(handlerCtx)
+	return rest.AccessLogRecord{
+		Time:       start,
+		Protocol:   "grpc",
+		Method:     method,
+		Peer:       peerAddress(ctx),
+		Principal:  principal.Subject,
+		Status:     status.Code(err).String(),
+		DurationMs: float64(time.Since(start)) / float64(time.Millisecond),
+		RequestID:  RequestID(handlerCtx),
+	}
+}
+
+// logAccess writes the record to the logger or to the standard logger if the
+// logger is nil
+func logAccess(logger *rest.AccessLogger, record rest.AccessLogRecord, failed bool) {
+	if logger == nil {
+		log.Printf("gRPC %s from %s: %s (%.1fms) principal=%s request-id=%s",
+			record.Method, record.Peer, record.Status, record.DurationMs, record.Principal, record.RequestID)
+		return
+	}
+	logger.Log(record, failed)
+}
+
+// AccessLogInterceptor returns interceptors that log every call with the
+// method name, peer address, principal, status code and duration. The
+// principal is the authenticated principal or the client certificate and is
+// resolved when the call completes, so add it before the authentication
+// interceptor to log calls that fail authentication. Add it after the request
+// ID interceptor to include the request ID.
+//
+// Calls are logged with the standard logger if the logger is nil. Otherwise
+// the records have the same fields as the HTTP access logs from
+// rest.AccessLogWrapper and include the message counts for streams. Failed
+// calls are always logged while successful calls are sampled according to
+// the logger's sample rate.
+func AccessLogInterceptor(logger *rest.AccessLogger) ServerInterceptor {
+	return ServerInterceptor{
+		Unary: func(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+			if logger != nil && !logger.Enabled(info.FullMethod) {
+				return handler(ctx, req)
+			}
+			start := time.Now()
+			handlerCtx, recorded := withHandlerContext(ctx)
+			resp, err := handler(handlerCtx, req)
+			logAccess(logger, accessLogRecord(ctx, recorded.get(), info.FullMethod, start, err), err != nil)
+			return resp, err
+		},
+		Stream: func(srv interface{}, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+			if logger != nil && !logger.Enabled(info.FullMethod) {
+				return handler(srv, ss)
+			}
+			start := time.Now()
+			handlerCtx, recorded := withHandlerContext(ss.Context())
+			stream := &countingStream{ServerStream: ss, ctx: handlerCtx}
+			err := handler(srv, stream)
+			record := accessLogRecord(ss.Context(), recorded.get(), info.FullMethod, start, err)
+			record.MessagesReceived = int(atomic.LoadInt64(&stream.received))
+			record.MessagesSent = int(atomic.LoadInt64(&stream.sent))
+			logAccess(logger, record, err != nil)
+			return err
+		},
+	}
+}
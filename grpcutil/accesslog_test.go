@@ -0,0 +1,185 @@
+package grpcutil
+
+//
+//Copyright 2019 Telenor Digital AS
+//
+//Licensed under the Apache License, Version 2.0 (the "License");
+//you may not use this file except in compliance with the License.
+//You may obtain a copy of the License at
+//
+//http://www.apache.org/licenses/LICENSE-2.0
+//
+//Unless required by applicable law or agreed to in writing, software
+//distributed under the License is distributed on an "AS IS" BASIS,
+//WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//See the License for the specific language governing permissions and
+//limitations under the License.
+//
+import (
+	"bytes"
+	"context"
+	"crypto/x509"
+	"encoding/json"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/lab5e/gotoolbox/rest"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/health/grpc_health_v1"
+)
+
+// syncBuffer is a buffer that is safe for concurrent use
+type syncBuffer struct {
+	mutex sync.Mutex
+	buf   bytes.Buffer
+}
+
+func (s *syncBuffer) Write(p []byte) (int, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.buf.Write(p)
+}
+
+// records returns the access log records written so far
+func (s *syncBuffer) records(t *testing.T) []rest.AccessLogRecord {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	var ret []rest.AccessLogRecord
+	for _, line := range strings.Split(strings.TrimSpace(s.buf.String()), "\n") {
+		if line == "" {
+			continue
+		}
+		var record rest.AccessLogRecord
+		require.NoError(t, json.Unmarshal([]byte(line), &record))
+		ret = append(ret, record)
+	}
+	return ret
+}
+
+func TestAccessLog(t *testing.T) {
+	assert := require.New(t)
+
+	out := &syncBuffer{}
+	logger := rest.NewAccessLogger(out, rest.AccessLogConfig{})
+	verifier := NewMemoryTokenVerifier(map[string]Principal{"token-1": {Subject: "alice"}})
+	serverOpts := chainInterceptors([]ServerInterceptor{RequestIDInterceptor(), AccessLogInterceptor(logger), BearerTokenInterceptor(verifier)})
+	_, conn := NewTestServer(t, GRPCServerParam{Health: true}, GRPCClientParam{Token: "token-1"}, func(s *grpc.Server) {}, serverOpts)
+	client := grpc_health_v1.NewHealthClient(conn)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	_, err := client.Check(ctx, &grpc_health_v1.HealthCheckRequest{})
+	assert.NoError(err)
+
+	records := out.records(t)
+	assert.Len(records, 1)
+	assert.Equal("grpc", records[0].Protocol)
+	assert.Equal("/grpc.health.v1.Health/Check", records[0].Method)
+	assert.Equal("alice", records[0].Principal)
+	assert.Equal("OK", records[0].Status)
+	assert.NotEmpty(records[0].Peer)
+	assert.NotEmpty(records[0].RequestID)
+
+	// Streams include the message counts
+	streamCtx, streamCancel := context.WithCancel(ctx)
+	stream, err := client.Watch(streamCtx, &grpc_health_v1.HealthCheckRequest{})
+	assert.NoError(err)
+	_, err = stream.Recv()
+	assert.NoError(err)
+	streamCancel()
+	assert.Eventually(func() bool { return len(out.records(t)) == 2 }, time.Second, 10*time.Millisecond)
+	record := out.records(t)[1]
+	assert.Equal("Canceled", record.Status)
+	assert.Equal(1, record.MessagesReceived)
+	assert.Equal(1, record.MessagesSent)
+}
+
+func TestAccessLogSampling(t *testing.T) {
+	assert := require.New(t)
+
+	out := &syncBuffer{}
+	logger := rest.NewAccessLogger(out, rest.AccessLogConfig{SampleRate: 1e-9, Suppress: []string{"/grpc.health.v1.Health/Watch"}})
+	verifier := NewMemoryTokenVerifier(map[string]Principal{"token-1": {Subject: "alice"}})
+	serverOpts := chainInterceptors([]ServerInterceptor{AccessLogInterceptor(logger), BearerTokenInterceptor(verifier)})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	// Successful calls are sampled
+	_, conn := NewTestServer(t, GRPCServerParam{Health: true}, GRPCClientParam{Token: "token-1"}, func(s *grpc.Server) {}, serverOpts)
+	_, err := grpc_health_v1.NewHealthClient(conn).Check(ctx, &grpc_health_v1.HealthCheckRequest{})
+	assert.NoError(err)
+	assert.Len(out.records(t), 0)
+
+	// Failed calls are always logged unless the method is suppressed
+	_, conn = NewTestServer(t, GRPCServerParam{Health: true}, GRPCClientParam{Token: "wrong"}, func(s *grpc.Server) {}, serverOpts)
+	_, err = grpc_health_v1.NewHealthClient(conn).Check(ctx, &grpc_health_v1.HealthCheckRequest{})
+	assert.Error(err)
+	stream, err := grpc_health_v1.NewHealthClient(conn).Watch(ctx, &grpc_health_v1.HealthCheckRequest{})
+	assert.NoError(err)
+	_, err = stream.Recv()
+	assert.Error(err)
+
+	records := out.records(t)
+	assert.Len(records, 1)
+	assert.Equal("Unauthenticated", records[0].Status)
+	assert.Empty(records[0].Principal)
+}
+
+func TestAccessLogPrincipal(t *testing.T) {
+	assert := require.New(t)
+
+	ca := newTestCA(t)
+	serverCert, serverKey := ca.Issue("server", x509.ExtKeyUsageServerAuth)
+	clientCert, clientKey := ca.Issue("client", x509.ExtKeyUsageClientAuth)
+
+	out := &syncBuffer{}
+	logger := rest.NewAccessLogger(out, rest.AccessLogConfig{})
+	verifier := NewMemoryTokenVerifier(map[string]Principal{"token-1": {Subject: "alice"}})
+	server, err := NewGRPCServer(GRPCServerParam{
+		Endpoint:     "127.0.0.1:0",
+		Health:       true,
+		TLS:          true,
+		CertFile:     serverCert,
+		KeyFile:      serverKey,
+		ClientCAFile: ca.CAFile,
+	})
+	assert.NoError(err)
+	// The principal is resolved when the call completes so the
+	// authentication interceptor can be added separately
+	server.AddInterceptors(AccessLogInterceptor(logger))
+	server.AddInterceptors(OptionalBearerTokenInterceptor(verifier))
+	assert.NoError(server.Launch(func(s *grpc.Server) {}, time.Second))
+	defer server.Stop()
+
+	clientConfig := GRPCClientParam{
+		ServerEndpoint:     server.ListenAddress().String(),
+		TLS:                true,
+		CAFile:             ca.CAFile,
+		ServerHostOverride: "localhost",
+		CertFile:           clientCert,
+		KeyFile:            clientKey,
+	}
+	conn, err := NewGRPCClientConnection(clientConfig)
+	assert.NoError(err)
+	defer conn.Close()
+	client := grpc_health_v1.NewHealthClient(conn)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	// Clients with certificates are logged with the common name
+	_, err = client.Check(ctx, &grpc_health_v1.HealthCheckRequest{})
+	assert.NoError(err)
+	// Bearer tokens take precedence over the certificate
+	_, err = client.Check(ctx, &grpc_health_v1.HealthCheckRequest{}, grpc.PerRPCCredentials(NewTokenCredentials("token-1", true)))
+	assert.NoError(err)
+
+	records := out.records(t)
+	assert.Len(records, 2)
+	assert.Equal("client", records[0].Principal)
+	assert.Equal("alice", records[1].Principal)
+}
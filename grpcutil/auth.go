@@ -0,0 +1,143 @@
+package grpcutil
+
+//
+//Copyright 2019 Telenor Digital AS
+//
+//Licensed under the Apache License, Version 2.0 (the "License");
+//you may not use this file except in compliance with the License.
+//You may obtain a copy of the License at
+//
+//http://www.apache.org/licenses/LICENSE-2.0
+//
+//Unless required by applicable law or agreed to in writing, software
+//distributed under the License is distributed on an "AS IS" BASIS,
+//WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//See the License for the specific language governing permissions and
+//limitations under the License.
+//
+import (
+	"context"
+	"errors"
+	"strings"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+// Principal is the authenticated identity for a call
+type Principal struct {
+	Subject string   // The subject, ie the user or service name
+	Roles   []string // Roles or scopes granted to the subject
+}
+
+type principalKey struct{}
+
+// NewContextWithPrincipal returns a new context with the principal
+func NewContextWithPrincipal(ctx context.Context, principal Principal) context.Context {
+	return context.WithValue(ctx, principalKey{}, principal)
+}
+
+// PrincipalFromContext returns the principal set by the authentication
+// interceptor
+func PrincipalFromContext(ctx context.Context) (Principal, bool) {
+	principal, ok := ctx.Value(principalKey{}).(Principal)
+	return principal, ok
+}
+
+// TokenVerifier verifies bearer tokens
+type TokenVerifier interface {
+	// Verify checks the token and returns the principal the token is issued
+	// to. An error is returned if the token is invalid.
+	Verify(ctx context.Context, token string) (Principal, error)
+}
+
+// MemoryTokenVerifier is a memory-backed token verifier. Suitable for testing, nothing more.
+type MemoryTokenVerifier struct {
+	tokens map[string]Principal
+}
+
+// NewMemoryTokenVerifier creates a new MemoryTokenVerifier instance with a
+// map of tokens to principals
+func NewMemoryTokenVerifier(tokens map[string]Principal) *MemoryTokenVerifier {
+	return &MemoryTokenVerifier{tokens}
+}
+
+// Verify looks up the token
+func (m *MemoryTokenVerifier) Verify(ctx context.Context, token string) (Principal, error) {
+	principal, ok := m.tokens[token]
+	if !ok {
+		return Principal{}, errors.New("unknown token")
+	}
+	return principal, nil
+}
+
+// bearerToken returns the bearer token from the authorization metadata
+func bearerToken(ctx context.Context) (string, bool) {
+	md, ok := metadata.FromIncomingContext(ctx)
+	if !ok {
+		return "", false
+	}
+	for _, value := range md.Get("authorization") {
+		s := strings.SplitN(value, " ", 2)
+		if len(s) == 2 && strings.EqualFold(s[0], "bearer") && s[1] != "" {
+			return s[1], true
+		}
+	}
+	return "", false
+}
+
+// authenticate verifies the bearer token and returns a context with the
+// principal. If the token is optional calls without a token are passed
+// through with the context unchanged.
+func authenticate(ctx context.Context, verifier TokenVerifier, optional bool) (context.Context, error) {
+	token, ok := bearerToken(ctx)
+	if !ok {
+		if optional {
+			return ctx, nil
+		}
+		return nil, status.Error(codes.Unauthenticated, "missing bearer token")
+	}
+	principal, err := verifier.Verify(ctx, token)
+	if err != nil {
+		return nil, status.Error(codes.Unauthenticated, "invalid bearer token")
+	}
+	return NewContextWithPrincipal(ctx, principal), nil
+}
+
+// BearerTokenInterceptor returns interceptors that authenticate calls with a
+// bearer token in the authorization metadata. Calls without a valid token
+// are rejected with Unauthenticated. Use PrincipalFromContext to get the
+// principal in the handlers.
+func BearerTokenInterceptor(verifier TokenVerifier) ServerInterceptor {
+	return bearerTokenInterceptor(verifier, false)
+}
+
+// OptionalBearerTokenInterceptor returns interceptors that authenticate calls
+// with a bearer token like BearerTokenInterceptor but passes calls without a
+// token through without a principal. Calls with an invalid token are still
+// rejected. Use this with the AuthorizationInterceptor to let the policy
+// decide which methods allow unauthenticated calls or client certificates.
+func OptionalBearerTokenInterceptor(verifier TokenVerifier) ServerInterceptor {
+	return bearerTokenInterceptor(verifier, true)
+}
+
+func bearerTokenInterceptor(verifier TokenVerifier, optional bool) ServerInterceptor {
+	return ServerInterceptor{
+		Unary: func(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+			ctx, err := authenticate(ctx, verifier, optional)
+			if err != nil {
+				return nil, err
+			}
+			return handler(ctx, req)
+		},
+		Stream: func(srv interface{}, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+			ctx, err := authenticate(ss.Context(), verifier, optional)
+			if err != nil {
+				return err
+			}
+			return handler(srv, &contextStream{ServerStream: ss, ctx: ctx})
+		},
+	}
+}
@@ -0,0 +1,110 @@
+package grpcutil
+
+//
+//Copyright 2019 Telenor Digital AS
+//
+//Licensed under the Apache License, Version 2.0 (the "License");
+//you may not use this file except in compliance with the License.
+//You may obtain a copy of the License at
+//
+//http://www.apache.org/licenses/LICENSE-2.0
+//
+//Unless required by applicable law or agreed to in writing, software
+//distributed under the License is distributed on an "AS IS" BASIS,
+//WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//See the License for the specific language governing permissions and
+//limitations under the License.
+//
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/health/grpc_health_v1"
+	"google.golang.org/grpc/status"
+)
+
+// principalRecorder records the subject of the principal for each call
+func principalRecorder(subjects chan<- string) ServerInterceptor {
+	return ServerInterceptor{
+		Unary: func(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+			principal, _ := PrincipalFromContext(ctx)
+			subjects <- principal.Subject
+			return handler(ctx, req)
+		},
+	}
+}
+
+func TestBearerTokenAuthentication(t *testing.T) {
+	assert := require.New(t)
+
+	verifier := NewMemoryTokenVerifier(map[string]Principal{
+		"token-1": {Subject: "alice"},
+		"token-2": {Subject: "bob"},
+	})
+	tokenFile := filepath.Join(t.TempDir(), "token")
+	assert.NoError(os.WriteFile(tokenFile, []byte("token-1\n"), 0600))
+
+	subjects := make(chan string, 1)
+	serverOpts := chainInterceptors([]ServerInterceptor{BearerTokenInterceptor(verifier), principalRecorder(subjects)})
+	_, conn := NewTestServer(t, GRPCServerParam{Health: true}, GRPCClientParam{TokenFile: tokenFile}, func(s *grpc.Server) {}, serverOpts)
+	client := grpc_health_v1.NewHealthClient(conn)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	_, err := client.Check(ctx, &grpc_health_v1.HealthCheckRequest{})
+	assert.NoError(err)
+	assert.Equal("alice", <-subjects)
+
+	// Rotate the token. The modification time and size are unchanged, as
+	// when the file is rewritten within the file system's timestamp
+	// granularity, so the token is picked up when the file is read again.
+	fi, err := os.Stat(tokenFile)
+	assert.NoError(err)
+	assert.NoError(os.WriteFile(tokenFile, []byte("token-2\n"), 0600))
+	assert.NoError(os.Chtimes(tokenFile, fi.ModTime(), fi.ModTime()))
+	assert.Eventually(func() bool {
+		_, err := client.Check(ctx, &grpc_health_v1.HealthCheckRequest{})
+		return err == nil && <-subjects == "bob"
+	}, 3*tokenRereadInterval, 50*time.Millisecond)
+
+	// The previous token is kept if the file is emptied
+	assert.NoError(os.WriteFile(tokenFile, nil, 0600))
+	assert.NoError(os.Chtimes(tokenFile, time.Now(), time.Now().Add(time.Second)))
+	_, err = client.Check(ctx, &grpc_health_v1.HealthCheckRequest{})
+	assert.NoError(err)
+	assert.Equal("bob", <-subjects)
+
+	// Streams are authenticated too
+	stream, err := client.Watch(ctx, &grpc_health_v1.HealthCheckRequest{})
+	assert.NoError(err)
+	_, err = stream.Recv()
+	assert.NoError(err)
+}
+
+func TestBearerTokenRejected(t *testing.T) {
+	assert := require.New(t)
+
+	verifier := NewMemoryTokenVerifier(map[string]Principal{"token-1": {Subject: "alice"}})
+	serverOpts := chainInterceptors([]ServerInterceptor{BearerTokenInterceptor(verifier)})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	_, conn := NewTestServer(t, GRPCServerParam{Health: true}, GRPCClientParam{}, func(s *grpc.Server) {}, serverOpts)
+	_, err := grpc_health_v1.NewHealthClient(conn).Check(ctx, &grpc_health_v1.HealthCheckRequest{})
+	assert.Equal(codes.Unauthenticated, status.Code(err))
+
+	_, conn = NewTestServer(t, GRPCServerParam{Health: true}, GRPCClientParam{Token: "wrong"}, func(s *grpc.Server) {}, serverOpts)
+	_, err = grpc_health_v1.NewHealthClient(conn).Check(ctx, &grpc_health_v1.HealthCheckRequest{})
+	assert.Equal(codes.Unauthenticated, status.Code(err))
+
+	_, err = GetDialOpts(GRPCClientParam{Token: "token", TokenFile: "token.txt"})
+	assert.Error(err)
+}
@@ -0,0 +1,249 @@
+package grpcutil
+
+//
+//Copyright 2019 Telenor Digital AS
+//
+//Licensed under the Apache License, Version 2.0 (the "License");
+//you may not use this file except in compliance with the License.
+//You may obtain a copy of the License at
+//
+//http://www.apache.org/licenses/LICENSE-2.0
+//
+//Unless required by applicable law or agreed to in writing, software
+//distributed under the License is distributed on an "AS IS" BASIS,
+//WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//See the License for the specific language governing permissions and
+//limitations under the License.
+//
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path"
+	"sync"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// AnyRole is the role that matches every authenticated principal
+const AnyRole = "*"
+
+// AuthzPolicy maps full method names to the roles or scopes that are
+// required to call them. The method names can have wildcards as in
+// path.Match, ie /package.Service/* matches every method in a service and a
+// single * matches every method. Exact matches are used before wildcards and
+// longer patterns before shorter ones. A principal must have one of the roles
+// for the method. The role * allows every authenticated principal and an
+// empty list of roles allows unauthenticated calls. Calls to methods that
+// don't match any pattern are denied.
+//
+// The policy file is a JSON object with patterns as keys and lists of roles
+// as values:
+//
+//	{
+//	    "/grpc.health.v1.Health/*": [],
+//	    "/example.Service/Get*": ["reader", "admin"],
+//	    "*": ["admin"]
+//	}
+type AuthzPolicy struct {
+	file    string
+	mutex   *sync.RWMutex
+	rules   map[string][]string
+	modTime time.Time
+}
+
+// NewAuthzPolicy creates a policy from a map of method patterns to roles
+func NewAuthzPolicy(rules map[string][]string) (*AuthzPolicy, error) {
+	if err := validateAuthzRules(rules); err != nil {
+		return nil, err
+	}
+	return &AuthzPolicy{mutex: &sync.RWMutex{}, rules: rules}, nil
+}
+
+// LoadAuthzPolicy loads the policy from a JSON file. Use Reload or Watch to
+// reload the policy when the file changes.
+func LoadAuthzPolicy(file string) (*AuthzPolicy, error) {
+	ret := &AuthzPolicy{file: file, mutex: &sync.RWMutex{}}
+	if err := ret.Reload(); err != nil {
+		return nil, err
+	}
+	return ret, nil
+}
+
+// validateAuthzRules checks that the patterns are valid
+func validateAuthzRules(rules map[string][]string) error {
+	for pattern := range rules {
+		if _, err := path.Match(pattern, ""); err != nil {
+			return fmt.Errorf("invalid method pattern %s: %v", pattern, err)
+		}
+	}
+	return nil
+}
+
+// Reload loads the policy file. The current policy is kept if the file can't
+// be loaded.
+func (p *AuthzPolicy) Reload() error {
+	if p.file == "" {
+		return errors.New("the policy isn't loaded from a file")
+	}
+	var modTime time.Time
+	if fi, err := os.Stat(p.file); err == nil {
+		modTime = fi.ModTime()
+	}
+	buf, err := os.ReadFile(p.file)
+	if err != nil {
+		return err
+	}
+	rules := make(map[string][]string)
+	if err := json.Unmarshal(buf, &rules); err != nil {
+		return fmt.Errorf("invalid policy file %s: %v", p.file, err)
+	}
+	if err := validateAuthzRules(rules); err != nil {
+		return err
+	}
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	p.rules = rules
+	p.modTime = modTime
+	return nil
+}
+
+// changed returns true if the policy file has been modified since the last
+// load
+func (p *AuthzPolicy) changed() bool {
+	fi, err := os.Stat(p.file)
+	if err != nil {
+		return false
+	}
+	p.mutex.RLock()
+	defer p.mutex.RUnlock()
+	return !fi.ModTime().Equal(p.modTime)
+}
+
+// Watch checks the policy file for changes at regular intervals and reloads
+// the policy when it changes. Watch returns when the stop channel is closed.
+func (p *AuthzPolicy) Watch(interval time.Duration, stop <-chan struct{}) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			if !p.changed() {
+				continue
+			}
+			if err := p.Reload(); err != nil {
+				log.Printf("Unable to reload authorization policy from %s: %v", p.file, err)
+				continue
+			}
+			log.Printf("Reloaded authorization policy from %s", p.file)
+		case <-stop:
+			return
+		}
+	}
+}
+
+// roles returns the roles for the method from the best matching pattern
+func (p *AuthzPolicy) roles(method string) ([]string, bool) {
+	p.mutex.RLock()
+	defer p.mutex.RUnlock()
+	if roles, ok := p.rules[method]; ok {
+		return roles, true
+	}
+	best := ""
+	found := false
+	for pattern := range p.rules {
+		matched := pattern == "*"
+		if !matched {
+			matched, _ = path.Match(pattern, method)
+		}
+		if matched && (!found || len(pattern) > len(best) || (len(pattern) == len(best) && pattern < best)) {
+			best = pattern
+			found = true
+		}
+	}
+	return p.rules[best], found
+}
+
+// Authorize checks if the principal can call the method. The error is a
+// status error with Unauthenticated if the method requires a principal and
+// there is none and PermissionDenied if the principal doesn't have any of
+// the roles.
+func (p *AuthzPolicy) Authorize(method string, principal Principal, authenticated bool) error {
+	roles, ok := p.roles(method)
+	if !ok {
+		return status.Error(codes.PermissionDenied, "permission denied")
+	}
+	if len(roles) == 0 {
+		return nil
+	}
+	if !authenticated {
+		return status.Error(codes.Unauthenticated, "authentication required")
+	}
+	for _, required := range roles {
+		if required == AnyRole {
+			return nil
+		}
+		for _, role := range principal.Roles {
+			if role == required {
+				return nil
+			}
+		}
+	}
+	return status.Error(codes.PermissionDenied, "permission denied")
+}
+
+// callPrincipal returns the principal for a call. This is the principal set
+// by the authentication interceptor or, if there is none, the verified
+// client certificate with the common name as the subject and the
+// organizational units as the roles.
+func callPrincipal(ctx context.Context) (Principal, bool) {
+	if principal, ok := PrincipalFromContext(ctx); ok {
+		return principal, true
+	}
+	if cert, ok := PeerCertificate(ctx); ok {
+		return Principal{Subject: cert.Subject.CommonName, Roles: cert.Subject.OrganizationalUnit}, true
+	}
+	return Principal{}, false
+}
+
+// authorize checks the policy and logs and counts denied calls
+func authorize(ctx context.Context, policy *AuthzPolicy, method string) error {
+	principal, authenticated := callPrincipal(ctx)
+	err := policy.Authorize(method, principal, authenticated)
+	if err != nil {
+		authzDeniedCounter.WithLabelValues(method, status.Code(err).String()).Inc()
+		log.Printf("Denied call to %s from %s (subject %q, roles %v): %s", method, peerAddress(ctx), principal.Subject, principal.Roles, status.Code(err))
+	}
+	return err
+}
+
+// AuthorizationInterceptor returns interceptors that check every call
+// against the policy. The principal is taken from the context or from the
+// client certificate. Add it after the authentication interceptor and use
+// OptionalBearerTokenInterceptor if the policy allows unauthenticated calls
+// or client certificates since BearerTokenInterceptor rejects calls without
+// a token before the policy is checked. Denied
+// calls are logged and counted in the grpcutil_server_authz_denied_total
+// metric.
+func AuthorizationInterceptor(policy *AuthzPolicy) ServerInterceptor {
+	return ServerInterceptor{
+		Unary: func(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+			if err := authorize(ctx, policy, info.FullMethod); err != nil {
+				return nil, err
+			}
+			return handler(ctx, req)
+		},
+		Stream: func(srv interface{}, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+			if err := authorize(ss.Context(), policy, info.FullMethod); err != nil {
+				return err
+			}
+			return handler(srv, ss)
+		},
+	}
+}
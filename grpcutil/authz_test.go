@@ -0,0 +1,208 @@
+package grpcutil
+
+//
+//Copyright 2019 Telenor Digital AS
+//
+//Licensed under the Apache License, Version 2.0 (the "License");
+//you may not use this file except in compliance with the License.
+//You may obtain a copy of the License at
+//
+//http://www.apache.org/licenses/LICENSE-2.0
+//
+//Unless required by applicable law or agreed to in writing, software
+//distributed under the License is distributed on an "AS IS" BASIS,
+//WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//See the License for the specific language governing permissions and
+//limitations under the License.
+//
+import (
+	"context"
+	"crypto/x509"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/health/grpc_health_v1"
+	"google.golang.org/grpc/status"
+)
+
+func TestAuthzPolicy(t *testing.T) {
+	assert := require.New(t)
+
+	policy, err := NewAuthzPolicy(map[string][]string{
+		"/grpc.health.v1.Health/*": {},
+		"/test.Service/*":          {"reader", "writer"},
+		"/test.Service/Update*":    {"writer"},
+		"/test.Service/Delete":     {"admin"},
+		"/test.Other/Get":          {AnyRole},
+	})
+	assert.NoError(err)
+
+	reader := Principal{Subject: "alice", Roles: []string{"reader"}}
+	writer := Principal{Subject: "bob", Roles: []string{"writer"}}
+	admin := Principal{Subject: "carol", Roles: []string{"admin"}}
+
+	assert.NoError(policy.Authorize("/grpc.health.v1.Health/Check", Principal{}, false))
+	assert.NoError(policy.Authorize("/test.Service/Get", reader, true))
+	assert.NoError(policy.Authorize("/test.Service/UpdateItem", writer, true))
+	assert.NoError(policy.Authorize("/test.Service/Delete", admin, true))
+	assert.NoError(policy.Authorize("/test.Other/Get", Principal{Subject: "dave"}, true))
+
+	assert.Equal(codes.PermissionDenied, status.Code(policy.Authorize("/test.Service/UpdateItem", reader, true)))
+	assert.Equal(codes.PermissionDenied, status.Code(policy.Authorize("/test.Service/Delete", writer, true)))
+	assert.Equal(codes.PermissionDenied, status.Code(policy.Authorize("/test.Service/Get", admin, true)))
+	assert.Equal(codes.Unauthenticated, status.Code(policy.Authorize("/test.Other/Get", Principal{}, false)))
+
+	// Methods without a rule are denied
+	assert.Equal(codes.PermissionDenied, status.Code(policy.Authorize("/test.Unknown/Get", admin, true)))
+
+	_, err = NewAuthzPolicy(map[string][]string{"/test.Service/[": {"admin"}})
+	assert.Error(err)
+}
+
+func TestAuthzPolicyReload(t *testing.T) {
+	assert := require.New(t)
+
+	policyFile := filepath.Join(t.TempDir(), "policy.json")
+	_, err := LoadAuthzPolicy(policyFile)
+	assert.Error(err)
+
+	assert.NoError(os.WriteFile(policyFile, []byte(`{"*": ["admin"]}`), 0600))
+	policy, err := LoadAuthzPolicy(policyFile)
+	assert.NoError(err)
+
+	reader := Principal{Subject: "alice", Roles: []string{"reader"}}
+	assert.Equal(codes.PermissionDenied, status.Code(policy.Authorize("/test.Service/Get", reader, true)))
+
+	stop := make(chan struct{})
+	defer close(stop)
+	go policy.Watch(10*time.Millisecond, stop)
+
+	assert.NoError(os.WriteFile(policyFile, []byte(`{"*": ["admin", "reader"]}`), 0600))
+	assert.NoError(os.Chtimes(policyFile, time.Now(), time.Now().Add(time.Second)))
+	assert.Eventually(func() bool {
+		return policy.Authorize("/test.Service/Get", reader, true) == nil
+	}, 5*time.Second, 10*time.Millisecond)
+
+	// Invalid files keep the current policy
+	assert.NoError(os.WriteFile(policyFile, []byte(`{"*": `), 0600))
+	assert.Error(policy.Reload())
+	assert.NoError(policy.Authorize("/test.Service/Get", reader, true))
+}
+
+func TestAuthorizationInterceptor(t *testing.T) {
+	assert := require.New(t)
+
+	verifier := NewMemoryTokenVerifier(map[string]Principal{
+		"token-1": {Subject: "alice", Roles: []string{"reader"}},
+		"token-2": {Subject: "bob", Roles: []string{"admin"}},
+	})
+	policy, err := NewAuthzPolicy(map[string][]string{
+		"/grpc.health.v1.Health/*": {AnyRole},
+		"/test.Echo/*":             {"admin"},
+	})
+	assert.NoError(err)
+	serverOpts := chainInterceptors([]ServerInterceptor{BearerTokenInterceptor(verifier), AuthorizationInterceptor(policy)})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	denied := sampleCount(t, "grpcutil_server_authz_denied_total", "/test.Echo/Echo")
+
+	_, conn := NewTestServer(t, GRPCServerParam{Health: true}, GRPCClientParam{Token: "token-1"}, registerEcho, serverOpts)
+	_, err = grpc_health_v1.NewHealthClient(conn).Check(ctx, &grpc_health_v1.HealthCheckRequest{})
+	assert.NoError(err)
+	assert.Equal(codes.PermissionDenied, status.Code(callEcho(ctx, conn)))
+	assert.Equal(denied+1, sampleCount(t, "grpcutil_server_authz_denied_total", "/test.Echo/Echo"))
+
+	_, conn = NewTestServer(t, GRPCServerParam{Health: true}, GRPCClientParam{Token: "token-2"}, registerEcho, serverOpts)
+	assert.NoError(callEcho(ctx, conn))
+
+	// Streams are checked too
+	stream, err := grpc_health_v1.NewHealthClient(conn).Watch(ctx, &grpc_health_v1.HealthCheckRequest{})
+	assert.NoError(err)
+	_, err = stream.Recv()
+	assert.NoError(err)
+}
+
+func TestAuthorizationWithClientCertificate(t *testing.T) {
+	assert := require.New(t)
+
+	ca := newTestCA(t)
+	serverCert, serverKey := ca.Issue("server", x509.ExtKeyUsageServerAuth)
+	clientCert, clientKey := ca.Issue("client", x509.ExtKeyUsageClientAuth)
+
+	policy, err := NewAuthzPolicy(map[string][]string{"/grpc.health.v1.Health/*": {AnyRole}})
+	assert.NoError(err)
+	subjects := make(chan string, 1)
+	serverOpts := chainInterceptors([]ServerInterceptor{AuthorizationInterceptor(policy), {
+		Unary: func(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+			principal, _ := callPrincipal(ctx)
+			subjects <- principal.Subject
+			return handler(ctx, req)
+		},
+	}})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	serverParams := GRPCServerParam{Health: true, TLS: true, CertFile: serverCert, KeyFile: serverKey, ClientCAFile: ca.CAFile}
+	clientParams := GRPCClientParam{TLS: true, CAFile: ca.CAFile, ServerHostOverride: "localhost", CertFile: clientCert, KeyFile: clientKey}
+	_, conn := NewTestServer(t, serverParams, clientParams, func(s *grpc.Server) {}, serverOpts)
+	_, err = grpc_health_v1.NewHealthClient(conn).Check(ctx, &grpc_health_v1.HealthCheckRequest{})
+	assert.NoError(err)
+	assert.Equal("client", <-subjects)
+
+	// Clients without a certificate are unauthenticated
+	clientParams.CertFile, clientParams.KeyFile = "", ""
+	_, conn = NewTestServer(t, serverParams, clientParams, func(s *grpc.Server) {}, serverOpts)
+	_, err = grpc_health_v1.NewHealthClient(conn).Check(ctx, &grpc_health_v1.HealthCheckRequest{})
+	assert.Equal(codes.Unauthenticated, status.Code(err))
+}
+
+func TestAuthorizationWithOptionalToken(t *testing.T) {
+	assert := require.New(t)
+
+	ca := newTestCA(t)
+	serverCert, serverKey := ca.Issue("server", x509.ExtKeyUsageServerAuth)
+	clientCert, clientKey := ca.Issue("client", x509.ExtKeyUsageClientAuth)
+
+	verifier := NewMemoryTokenVerifier(map[string]Principal{"token-1": {Subject: "alice", Roles: []string{"admin"}}})
+	policy, err := NewAuthzPolicy(map[string][]string{
+		"/grpc.health.v1.Health/*": {},
+		"/test.Echo/*":             {AnyRole},
+	})
+	assert.NoError(err)
+	serverOpts := chainInterceptors([]ServerInterceptor{OptionalBearerTokenInterceptor(verifier), AuthorizationInterceptor(policy)})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	// Unauthenticated calls are allowed by the policy
+	_, conn := NewTestServer(t, GRPCServerParam{Health: true}, GRPCClientParam{}, registerEcho, serverOpts)
+	_, err = grpc_health_v1.NewHealthClient(conn).Check(ctx, &grpc_health_v1.HealthCheckRequest{})
+	assert.NoError(err)
+	stream, err := grpc_health_v1.NewHealthClient(conn).Watch(ctx, &grpc_health_v1.HealthCheckRequest{})
+	assert.NoError(err)
+	_, err = stream.Recv()
+	assert.NoError(err)
+	assert.Equal(codes.Unauthenticated, status.Code(callEcho(ctx, conn)))
+
+	// Invalid tokens are still rejected
+	_, conn = NewTestServer(t, GRPCServerParam{Health: true}, GRPCClientParam{Token: "token-2"}, registerEcho, serverOpts)
+	_, err = grpc_health_v1.NewHealthClient(conn).Check(ctx, &grpc_health_v1.HealthCheckRequest{})
+	assert.Equal(codes.Unauthenticated, status.Code(err))
+
+	_, conn = NewTestServer(t, GRPCServerParam{Health: true}, GRPCClientParam{Token: "token-1"}, registerEcho, serverOpts)
+	assert.NoError(callEcho(ctx, conn))
+
+	// Client certificates are used when there's no token
+	serverParams := GRPCServerParam{Health: true, TLS: true, CertFile: serverCert, KeyFile: serverKey, ClientCAFile: ca.CAFile}
+	clientParams := GRPCClientParam{TLS: true, CAFile: ca.CAFile, ServerHostOverride: "localhost", CertFile: clientCert, KeyFile: clientKey}
+	_, conn = NewTestServer(t, serverParams, clientParams, registerEcho, serverOpts)
+	assert.NoError(callEcho(ctx, conn))
+}
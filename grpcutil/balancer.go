@@ -0,0 +1,101 @@
+package grpcutil
+
+//
+//Copyright 2019 Telenor Digital AS
+//
+//Licensed under the Apache License, Version 2.0 (the "License");
+//you may not use this file except in compliance with the License.
+//You may obtain a copy of the License at
+//
+//http://www.apache.org/licenses/LICENSE-2.0
+//
+//Unless required by applicable law or agreed to in writing, software
+//distributed under the License is distributed on an "AS IS" BASIS,
+//WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//See the License for the specific language governing permissions and
+//limitations under the License.
+//
+import (
+	"errors"
+	"fmt"
+	"strings"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/resolver"
+	"google.golang.org/grpc/resolver/manual"
+)
+
+// Load balancing policies for client connections
+const (
+	PickFirst  = "pick_first"
+	RoundRobin = "round_robin"
+)
+
+// staticScheme is the resolver scheme used for endpoint lists. The resolver
+// is registered per connection so the name doesn't have to be unique.
+const staticScheme = "grpcutil-static"
+
+// splitEndpoints splits a comma-separated list of endpoints
+func splitEndpoints(endpoints string) []string {
+	var ret []string
+	for _, endpoint := range strings.Split(endpoints, ",") {
+		if endpoint = strings.TrimSpace(endpoint); endpoint != "" {
+			ret = append(ret, endpoint)
+		}
+	}
+	return ret
+}
+
+// clientTarget returns the dial target and dial options for the server
+// endpoint. A single endpoint is passed on to gRPC as is while lists of
+// host:port endpoints are resolved by a static resolver.
+func clientTarget(config GRPCClientParam) (string, []grpc.DialOption, error) {
+	endpoints := splitEndpoints(config.ServerEndpoint)
+	if len(endpoints) < 2 {
+		return config.ServerEndpoint, nil, nil
+	}
+
+	var addresses []resolver.Address
+	for _, endpoint := range endpoints {
+		if strings.HasPrefix(endpoint, unixPrefix) || strings.HasPrefix(endpoint, unixAbstractPrefix) {
+			return "", nil, fmt.Errorf("unix socket endpoints can't be used in a list: %s", endpoint)
+		}
+		// The server name is set for each address so TLS verifies the
+		// certificate against the backend's own host name.
+		addresses = append(addresses, resolver.Address{Addr: endpoint, ServerName: endpoint})
+	}
+	r := manual.NewBuilderWithScheme(staticScheme)
+	r.InitialState(resolver.State{Addresses: addresses})
+	return staticScheme + ":///" + endpoints[0], []grpc.DialOption{grpc.WithResolvers(r)}, nil
+}
+
+// balancerServiceConfig returns the service config for the load balancing
+// policy and health checks. An empty string is returned if neither is set
+// and metrics are disabled. The policy is wrapped in a policy that exports
+// the state of each backend when metrics are enabled. Health checks are only
+// supported by the round_robin policy in gRPC.
+func balancerServiceConfig(config GRPCClientParam) (string, error) {
+	switch config.LoadBalancingPolicy {
+	case "", PickFirst, RoundRobin:
+	default:
+		return "", fmt.Errorf("unknown load balancing policy: %s", config.LoadBalancingPolicy)
+	}
+	if config.HealthCheck && config.LoadBalancingPolicy != RoundRobin {
+		return "", errors.New("health checked connections require the round_robin policy")
+	}
+
+	var fields []string
+	switch {
+	case config.Metrics:
+		fields = append(fields, fmt.Sprintf(`"loadBalancingConfig":[{"%s":{"childPolicy":"%s"}}]`, monitoredBalancerName, config.LoadBalancingPolicy))
+	case config.LoadBalancingPolicy != "":
+		fields = append(fields, fmt.Sprintf(`"loadBalancingConfig":[{"%s":{}}]`, config.LoadBalancingPolicy))
+	}
+	if config.HealthCheck {
+		fields = append(fields, `"healthCheckConfig":{"serviceName":""}`)
+	}
+	if len(fields) == 0 {
+		return "", nil
+	}
+	return "{" + strings.Join(fields, ",") + "}", nil
+}
@@ -0,0 +1,150 @@
+package grpcutil
+
+//
+//Copyright 2019 Telenor Digital AS
+//
+//Licensed under the Apache License, Version 2.0 (the "License");
+//you may not use this file except in compliance with the License.
+//You may obtain a copy of the License at
+//
+//http://www.apache.org/licenses/LICENSE-2.0
+//
+//Unless required by applicable law or agreed to in writing, software
+//distributed under the License is distributed on an "AS IS" BASIS,
+//WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//See the License for the specific language governing permissions and
+//limitations under the License.
+//
+import (
+	"context"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/health/grpc_health_v1"
+)
+
+// newCountingServer launches a server that counts the unary calls it handles
+func newCountingServer(t *testing.T, calls *int64) GRPCServer {
+	assert := require.New(t)
+
+	server, err := NewGRPCServer(GRPCServerParam{Endpoint: "127.0.0.1:0", Health: true})
+	assert.NoError(err)
+	server.AddInterceptors(ServerInterceptor{
+		Unary: func(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+			atomic.AddInt64(calls, 1)
+			return handler(ctx, req)
+		},
+	})
+	assert.NoError(server.Launch(func(s *grpc.Server) {}, time.Second))
+	t.Cleanup(server.Stop)
+	return server
+}
+
+func TestRoundRobinWithHealthChecks(t *testing.T) {
+	assert := require.New(t)
+
+	var callsA, callsB int64
+	serverA := newCountingServer(t, &callsA)
+	serverB := newCountingServer(t, &callsB)
+
+	conn, err := NewGRPCClientConnection(GRPCClientParam{
+		ServerEndpoint:      serverA.ListenAddress().String() + "," + serverB.ListenAddress().String(),
+		LoadBalancingPolicy: RoundRobin,
+		HealthCheck:         true,
+	})
+	assert.NoError(err)
+	defer conn.Close()
+	client := grpc_health_v1.NewHealthClient(conn)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	callBackends := func() {
+		atomic.StoreInt64(&callsA, 0)
+		atomic.StoreInt64(&callsB, 0)
+		for i := 0; i < 10; i++ {
+			_, err := client.Check(ctx, &grpc_health_v1.HealthCheckRequest{}, grpc.WaitForReady(true))
+			assert.NoError(err)
+		}
+	}
+
+	// Both backends get calls once the connections are up
+	assert.Eventually(func() bool {
+		callBackends()
+		return atomic.LoadInt64(&callsA) > 0 && atomic.LoadInt64(&callsB) > 0
+	}, 2*time.Second, 10*time.Millisecond)
+
+	// Backends that aren't serving are skipped
+	serverB.SetServingStatus("", grpc_health_v1.HealthCheckResponse_NOT_SERVING)
+	assert.Eventually(func() bool {
+		callBackends()
+		return atomic.LoadInt64(&callsB) == 0
+	}, 2*time.Second, 10*time.Millisecond)
+	assert.Equal(int64(10), atomic.LoadInt64(&callsA))
+}
+
+func TestPickFirstWithEndpointList(t *testing.T) {
+	assert := require.New(t)
+
+	var callsA, callsB int64
+	serverA := newCountingServer(t, &callsA)
+	serverB := newCountingServer(t, &callsB)
+
+	conn, err := NewGRPCClientConnection(GRPCClientParam{
+		ServerEndpoint: serverA.ListenAddress().String() + ", " + serverB.ListenAddress().String(),
+	})
+	assert.NoError(err)
+	defer conn.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	for i := 0; i < 5; i++ {
+		_, err := grpc_health_v1.NewHealthClient(conn).Check(ctx, &grpc_health_v1.HealthCheckRequest{})
+		assert.NoError(err)
+	}
+	assert.Equal(int64(5), atomic.LoadInt64(&callsA))
+	assert.Equal(int64(0), atomic.LoadInt64(&callsB))
+	assert.True(strings.HasPrefix(conn.Target(), staticScheme+":///"))
+}
+
+func TestInvalidBalancerConfig(t *testing.T) {
+	assert := require.New(t)
+
+	_, err := NewGRPCClientConnection(GRPCClientParam{ServerEndpoint: "a:1,b:2", LoadBalancingPolicy: "random"})
+	assert.Error(err)
+
+	_, err = NewGRPCClientConnection(GRPCClientParam{ServerEndpoint: "a:1,b:2", LoadBalancingPolicy: PickFirst, HealthCheck: true})
+	assert.Error(err)
+
+	_, err = NewGRPCClientConnection(GRPCClientParam{ServerEndpoint: "a:1,unix:/tmp/grpc.sock"})
+	assert.Error(err)
+}
+
+func TestCallerServiceConfig(t *testing.T) {
+	assert := require.New(t)
+
+	var callsA, callsB int64
+	serverA := newCountingServer(t, &callsA)
+	serverB := newCountingServer(t, &callsB)
+
+	// The caller's service config replaces the one from the parameters
+	conn, err := NewGRPCClientConnection(GRPCClientParam{
+		ServerEndpoint:      serverA.ListenAddress().String() + "," + serverB.ListenAddress().String(),
+		LoadBalancingPolicy: PickFirst,
+		Metrics:             true,
+	}, grpc.WithDefaultServiceConfig(`{"loadBalancingConfig":[{"round_robin":{}}]}`))
+	assert.NoError(err)
+	defer conn.Close()
+	client := grpc_health_v1.NewHealthClient(conn)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	assert.Eventually(func() bool {
+		_, err := client.Check(ctx, &grpc_health_v1.HealthCheckRequest{}, grpc.WaitForReady(true))
+		assert.NoError(err)
+		return atomic.LoadInt64(&callsA) > 0 && atomic.LoadInt64(&callsB) > 0
+	}, 2*time.Second, 10*time.Millisecond)
+}
@@ -0,0 +1,146 @@
+package grpcutil
+
+//
+//Copyright 2019 Telenor Digital AS
+//
+//Licensed under the Apache License, Version 2.0 (the "License");
+//you may not use this file except in compliance with the License.
+//You may obtain a copy of the License at
+//
+//http://www.apache.org/licenses/LICENSE-2.0
+//
+//Unless required by applicable law or agreed to in writing, software
+//distributed under the License is distributed on an "AS IS" BASIS,
+//WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//See the License for the specific language governing permissions and
+//limitations under the License.
+//
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"log"
+	"os"
+	"sync"
+	"time"
+)
+
+// certReloader holds the server certificate and reloads it from the
+// certificate and key files. The certificate is handed out through the
+// GetCertificate callback in tls.Config so new handshakes use the most
+// recently loaded certificate while existing connections are left alone.
+type certReloader struct {
+	certFile string
+	keyFile  string
+	mutex    *sync.RWMutex
+	cert     *tls.Certificate
+	modTime  time.Time
+	failed   time.Time // Modification time of files that failed to load
+}
+
+// newCertReloader creates a new certificate reloader. The initial load must
+// succeed.
+func newCertReloader(certFile, keyFile string) (*certReloader, error) {
+	ret := &certReloader{
+		certFile: certFile,
+		keyFile:  keyFile,
+		mutex:    &sync.RWMutex{},
+	}
+	if err := ret.Reload(); err != nil {
+		return nil, err
+	}
+	return ret, nil
+}
+
+// Reload loads the certificate and key files. If the files can't be loaded
+// the current certificate is kept.
+func (c *certReloader) Reload() error {
+	if c.certFile == "" {
+		return errors.New("the certificate isn't loaded from a file")
+	}
+	modTime := c.lastModified()
+	cert, err := tls.LoadX509KeyPair(c.certFile, c.keyFile)
+	if err != nil {
+		c.loadFailed(modTime)
+		log.Printf("Unable to load certificate from %s and %s: %v", c.certFile, c.keyFile, err)
+		return err
+	}
+	if cert.Leaf == nil {
+		cert.Leaf, err = x509.ParseCertificate(cert.Certificate[0])
+		if err != nil {
+			c.loadFailed(modTime)
+			log.Printf("Unable to parse certificate in %s: %v", c.certFile, err)
+			return err
+		}
+	}
+	certReloadCounter.WithLabelValues("success").Inc()
+	certExpiryGauge.WithLabelValues(c.certFile).Set(float64(cert.Leaf.NotAfter.Unix()))
+
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.cert = &cert
+	c.modTime = modTime
+	return nil
+}
+
+// loadFailed records the modification time of files that can't be loaded
+// so the watcher doesn't retry until they change again
+func (c *certReloader) loadFailed(modTime time.Time) {
+	certReloadCounter.WithLabelValues("failure").Inc()
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.failed = modTime
+}
+
+// GetCertificate returns the current certificate. It is used as the
+// tls.Config.GetCertificate callback.
+func (c *certReloader) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	c.mutex.RLock()
+	defer c.mutex.RUnlock()
+	return c.cert, nil
+}
+
+// lastModified returns the most recent modification time of the certificate
+// and key files.
+func (c *certReloader) lastModified() time.Time {
+	var ret time.Time
+	for _, name := range []string{c.certFile, c.keyFile} {
+		fi, err := os.Stat(name)
+		if err != nil {
+			continue
+		}
+		if fi.ModTime().After(ret) {
+			ret = fi.ModTime()
+		}
+	}
+	return ret
+}
+
+// changed returns true if the files have been modified since the last load
+// attempt
+func (c *certReloader) changed() bool {
+	modTime := c.lastModified()
+	c.mutex.RLock()
+	defer c.mutex.RUnlock()
+	return !modTime.Equal(c.modTime) && !modTime.Equal(c.failed)
+}
+
+// Watch checks the certificate and key files for changes at regular
+// intervals and reloads the certificate when they change. Watch returns when
+// the stop channel is closed.
+func (c *certReloader) Watch(interval time.Duration, stop <-chan struct{}) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			if c.changed() {
+				if err := c.Reload(); err == nil {
+					log.Printf("Reloaded certificate from %s", c.certFile)
+				}
+			}
+		case <-stop:
+			return
+		}
+	}
+}
@@ -0,0 +1,127 @@
+package grpcutil
+
+//
+//Copyright 2019 Telenor Digital AS
+//
+//Licensed under the Apache License, Version 2.0 (the "License");
+//you may not use this file except in compliance with the License.
+//You may obtain a copy of the License at
+//
+//http://www.apache.org/licenses/LICENSE-2.0
+//
+//Unless required by applicable law or agreed to in writing, software
+//distributed under the License is distributed on an "AS IS" BASIS,
+//WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//See the License for the specific language governing permissions and
+//limitations under the License.
+//
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc"
+)
+
+func copyFile(t *testing.T, src, dst string) {
+	buf, err := os.ReadFile(src)
+	require.NoError(t, err)
+	require.NoError(t, os.WriteFile(dst, buf, 0600))
+}
+
+// servedCertificate returns the common name of the certificate served by the
+// server
+func servedCertificate(t *testing.T, ca *testCA, addr string) string {
+	pool, err := loadCertPool(ca.CAFile)
+	require.NoError(t, err)
+	conn, err := tls.Dial("tcp", addr, &tls.Config{RootCAs: pool, ServerName: "localhost", NextProtos: []string{"h2"}})
+	require.NoError(t, err)
+	defer conn.Close()
+	return conn.ConnectionState().PeerCertificates[0].Subject.CommonName
+}
+
+func TestCertificateReload(t *testing.T) {
+	assert := require.New(t)
+
+	ca := newTestCA(t)
+	certA, keyA := ca.Issue("server-a", x509.ExtKeyUsageServerAuth)
+	certB, keyB := ca.Issue("server-b", x509.ExtKeyUsageServerAuth)
+
+	certFile := filepath.Join(t.TempDir(), "server.crt")
+	keyFile := filepath.Join(t.TempDir(), "server.key")
+	copyFile(t, certA, certFile)
+	copyFile(t, keyA, keyFile)
+
+	server, err := NewGRPCServer(GRPCServerParam{
+		Endpoint:           "127.0.0.1:0",
+		TLS:                true,
+		CertFile:           certFile,
+		KeyFile:            keyFile,
+		CertReloadInterval: 10 * time.Millisecond,
+	})
+	assert.NoError(err)
+	assert.NoError(server.Launch(func(s *grpc.Server) {}, 100*time.Millisecond))
+	defer server.Stop()
+
+	addr := server.ListenAddress().String()
+	assert.Equal("server-a", servedCertificate(t, ca, addr))
+
+	// Files are picked up by the watcher
+	copyFile(t, certB, certFile)
+	copyFile(t, keyB, keyFile)
+	assert.Eventually(func() bool {
+		return servedCertificate(t, ca, addr) == "server-b"
+	}, time.Second, 10*time.Millisecond)
+
+	// The current certificate is kept when the files are invalid
+	assert.NoError(os.WriteFile(certFile, []byte("garbage"), 0600))
+	assert.Error(server.ReloadCertificates())
+	assert.Equal("server-b", servedCertificate(t, ca, addr))
+
+	// ...and reloaded on demand when they're fixed
+	copyFile(t, certA, certFile)
+	copyFile(t, keyA, keyFile)
+	assert.NoError(server.ReloadCertificates())
+	assert.Equal("server-a", servedCertificate(t, ca, addr))
+}
+
+func TestReloadWithoutTLS(t *testing.T) {
+	server, err := NewGRPCServer(GRPCServerParam{Endpoint: "127.0.0.1:0"})
+	require.NoError(t, err)
+	defer server.Stop()
+	require.Error(t, server.ReloadCertificates())
+}
+
+func TestCertificateReloadFailure(t *testing.T) {
+	assert := require.New(t)
+
+	ca := newTestCA(t)
+	certA, keyA := ca.Issue("server-a", x509.ExtKeyUsageServerAuth)
+	certFile := filepath.Join(t.TempDir(), "server.crt")
+	keyFile := filepath.Join(t.TempDir(), "server.key")
+	copyFile(t, certA, certFile)
+	copyFile(t, keyA, keyFile)
+
+	reloader, err := newCertReloader(certFile, keyFile)
+	assert.NoError(err)
+	assert.False(reloader.changed())
+	assert.Equal(float64(reloader.cert.Leaf.NotAfter.Unix()), testutil.ToFloat64(certExpiryGauge.WithLabelValues(certFile)))
+
+	// A failed load isn't retried until the files change again
+	assert.NoError(os.WriteFile(certFile, []byte("garbage"), 0600))
+	assert.NoError(os.Chtimes(certFile, time.Now(), time.Now().Add(time.Second)))
+	assert.True(reloader.changed())
+	assert.Error(reloader.Reload())
+	assert.False(reloader.changed())
+
+	copyFile(t, certA, certFile)
+	assert.NoError(os.Chtimes(certFile, time.Now(), time.Now().Add(2*time.Second)))
+	assert.True(reloader.changed())
+	assert.NoError(reloader.Reload())
+	assert.False(reloader.changed())
+}
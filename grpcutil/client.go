@@ -16,38 +16,113 @@ package grpcutil
 //limitations under the License.
 //
 import (
-	"errors"
-
+	grpc_prometheus "github.com/grpc-ecosystem/go-grpc-prometheus"
 	"google.golang.org/grpc"
 	"google.golang.org/grpc/credentials"
 	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/keepalive"
 )
 
 // GetDialOpts returns a populated grpc.DialOption array from the
-// client parameters.
+// client parameters. The metrics interceptors run before the retry
+// interceptor so the metrics include the time spent on retries. The default
+// service config for load balancing and health checks is the first option
+// so a service config added after the options takes precedence.
 func GetDialOpts(config GRPCClientParam) ([]grpc.DialOption, error) {
-	if !config.TLS {
-		return []grpc.DialOption{grpc.WithTransportCredentials(insecure.NewCredentials())}, nil
+	serviceOpts, err := serviceConfigOpts(config)
+	if err != nil {
+		return nil, err
+	}
+	opts, err := dialOpts(config)
+	if err != nil {
+		return nil, err
+	}
+	return append(serviceOpts, opts...), nil
+}
+
+// serviceConfigOpts returns the dial option for the default service config
+func serviceConfigOpts(config GRPCClientParam) ([]grpc.DialOption, error) {
+	serviceConfig, err := balancerServiceConfig(config)
+	if err != nil {
+		return nil, err
 	}
+	if serviceConfig == "" {
+		return nil, nil
+	}
+	return []grpc.DialOption{grpc.WithDefaultServiceConfig(serviceConfig)}, nil
+}
 
-	if config.CAFile == "" {
-		return nil, errors.New("missing CA file for TLS")
+// dialOpts returns the dial options except the default service config
+func dialOpts(config GRPCClientParam) ([]grpc.DialOption, error) {
+	var opts []grpc.DialOption
+	if config.Metrics {
+		opts = append(opts, grpc.WithChainUnaryInterceptor(grpc_prometheus.UnaryClientInterceptor))
+		opts = append(opts, grpc.WithChainStreamInterceptor(grpc_prometheus.StreamClientInterceptor))
+	}
+	if config.RetryMaxAttempts > 1 || len(config.RetryMethods) > 0 {
+		policy, err := retryPolicy(config)
+		if err != nil {
+			return nil, err
+		}
+		opts = append(opts, grpc.WithChainUnaryInterceptor(RetryInterceptor(policy, config.RetryMethods)))
+	}
+
+	if config.KeepaliveTime > 0 {
+		opts = append(opts, grpc.WithKeepaliveParams(keepalive.ClientParameters{
+			Time:                config.KeepaliveTime,
+			Timeout:             config.KeepaliveTimeout,
+			PermitWithoutStream: config.KeepalivePermitWithoutStream,
+		}))
 	}
 
-	creds, err := credentials.NewClientTLSFromFile(config.CAFile, config.ServerHostOverride)
+	tokenCreds, err := clientTokenCredentials(config)
 	if err != nil {
 		return nil, err
 	}
-	return []grpc.DialOption{grpc.WithTransportCredentials(creds)}, nil
+	if tokenCreds != nil {
+		opts = append(opts, grpc.WithPerRPCCredentials(tokenCreds))
+	}
+
+	if !config.TLS {
+		return append(opts, grpc.WithTransportCredentials(insecure.NewCredentials())), nil
+	}
+
+	tlsConfig, err := clientTLSConfig(config)
+	if err != nil {
+		return nil, err
+	}
+	return append(opts, grpc.WithTransportCredentials(credentials.NewTLS(tlsConfig))), nil
 }
 
-// NewGRPCClientConnection is a factory method to create gRPC client connections
+// NewGRPCClientConnection is a factory method to create gRPC client connections.
+// The state of each backend address is exported as metrics when metrics are
+// enabled. The connection is made lazily; use WaitForReady to wait for it.
+// A service config set with grpc.WithDefaultServiceConfig in the options
+// replaces the load balancing and health check configuration from the
+// parameters.
 func NewGRPCClientConnection(config GRPCClientParam, opts ...grpc.DialOption) (*grpc.ClientConn, error) {
-	configOpts, err := GetDialOpts(config)
+	serviceOpts, err := serviceConfigOpts(config)
+	if err != nil {
+		return nil, err
+	}
+	configOpts, err := dialOpts(config)
+	if err != nil {
+		return nil, err
+	}
+
+	target, targetOpts, err := clientTarget(config)
 	if err != nil {
 		return nil, err
 	}
 
+	// The last service config option wins so the caller's options go after
+	// the default service config
+	opts = append(serviceOpts, opts...)
 	opts = append(opts, configOpts...)
-	return grpc.NewClient(config.ServerEndpoint, opts...)
+	opts = append(opts, targetOpts...)
+	conn, err := grpc.NewClient(target, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return conn, nil
 }
@@ -15,13 +15,36 @@ package grpcutil
 //See the License for the specific language governing permissions and
 //limitations under the License.
 //
+import "time"
 
 // GRPCClientParam contains gRPC client parameters. These paramters are
 // the same for every gRPC client across the system.
 type GRPCClientParam struct {
-	ServerEndpoint     string `kong:"help='Server endpoint',default='localhost:10000'"` // Host:port address of the server
-	TLS                bool   `kong:"help='Enable TLS',default='false'"`                // TLS enabled
-	CAFile             string `kong:"help='CA certificate file',type='existingfile'"`   // CA cert file
-	ServerHostOverride string `kong:"help='Host name override for certificate'"`        // Server name returned from the TLS handshake (for debugging)
+	ServerEndpoint     string   `kong:"help='Server endpoint',default='localhost:10000'"`                                // Host:port address of the server, a comma-separated list of host:port addresses or unix:path for Unix domain sockets
+	TLS                bool     `kong:"help='Enable TLS',default='false'"`                                               // TLS enabled
+	CAFile             string   `kong:"help='CA certificate file (system CAs are used if not set)',type='existingfile'"` // CA cert file, the system cert pool is used if it's empty
+	ExtraCAFiles       []string `kong:"help='Additional CA certificate files'"`                                          // CA cert files added to the CA file or system cert pool
+	MinTLSVersion      string   `kong:"help='Minimum TLS version (1.2 or 1.3)',default='1.2',enum='1.2,1.3'"`            // Minimum TLS version
+	PinnedKeys         []string `kong:"help='Base64-encoded SHA-256 hashes of pinned server or CA public keys'"`         // SPKI hashes, one of them must be in the server's chain
+	ServerHostOverride string   `kong:"help='Host name override for certificate'"`                                       // Server name returned from the TLS handshake (for debugging)
+	CertFile           string   `kong:"help='Client certificate file',type='existingfile'"`                              // Client certificate for mutual TLS
+	KeyFile            string   `kong:"help='Client key file',type='existingfile'"`                                      // Client certificate key for mutual TLS
+	Token              string   `kong:"help='Bearer token'"`                                                             // Bearer token sent with every call
+	TokenFile          string   `kong:"help='Bearer token file',type='existingfile'"`                                    // File with bearer token, read again when modified
 
+	KeepaliveTime                time.Duration `kong:"help='Ping the server after this much inactivity (0 disables)',default='0s'"`              // Keepalive ping interval, minimum 10s
+	KeepaliveTimeout             time.Duration `kong:"help='Close the connection if a ping is not acknowledged within this time',default='20s'"` // Keepalive ping timeout
+	KeepalivePermitWithoutStream bool          `kong:"help='Send pings when there are no active streams',default='false'"`                       // Ping idle connections
+
+	Metrics bool `kong:"help='Add Prometheus interceptors and connection state metrics for client',default='true'"` // Client metrics
+
+	LoadBalancingPolicy string `kong:"help='Load balancing policy (pick_first or round_robin)',default='pick_first',enum='pick_first,round_robin'"` // Policy for picking a backend
+	HealthCheck         bool   `kong:"help='Skip backends that are not serving (requires round_robin)',default='false'"`                            // Client-side health checks
+
+	RetryMaxAttempts       int                    `kong:"help='Maximum number of attempts for unary calls (1 disables retries)',default='1'"` // Attempts including the first call
+	RetryInitialBackoff    time.Duration          `kong:"help='Initial backoff between retries',default='100ms'"`                             // Backoff before the first retry
+	RetryMaxBackoff        time.Duration          `kong:"help='Maximum backoff between retries',default='5s'"`                                // Upper limit for the backoff
+	RetryBackoffMultiplier float64                `kong:"help='Backoff multiplier for each retry',default='2'"`                               // Backoff growth per attempt
+	RetryCodes             []string               `kong:"help='Status codes to retry',default='UNAVAILABLE'"`                                 // Status code names, ie UNAVAILABLE
+	RetryMethods           map[string]RetryPolicy `kong:"-"`                                                                                  // Per-method retry policies keyed on the full method name
 }
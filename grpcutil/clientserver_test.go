@@ -20,7 +20,7 @@ import (
 )
 
 func TestInvalidServerTLSConfig(t *testing.T) {
-	serverConfig := GRPCServerParam{"localhost:0", true, "", "", false}
+	serverConfig := GRPCServerParam{Endpoint: "localhost:0", TLS: true}
 	server, err := NewGRPCServer(serverConfig)
 	if err != nil {
 		t.Fatal(err)
@@ -31,21 +31,21 @@ func TestInvalidServerTLSConfig(t *testing.T) {
 }
 
 func TestInvalidClientTLSConfig(t *testing.T) {
-	clientConfig := GRPCClientParam{"127.0.0.1:0", true, "", ""}
+	clientConfig := GRPCClientParam{ServerEndpoint: "127.0.0.1:0", TLS: true, MinTLSVersion: "1.0"}
 	if _, err := NewGRPCClientConnection(clientConfig); err == nil {
-		t.Fatal("Expected error with incorrect TLS flag but no error returned")
+		t.Fatal("Expected error with unsupported TLS version but no error returned")
 	}
 }
 
 func TestInvalidClientTLSFiles(t *testing.T) {
-	clientConfig := GRPCClientParam{"127.0.0.1:0", true, "foo.ca", ""}
+	clientConfig := GRPCClientParam{ServerEndpoint: "127.0.0.1:0", TLS: true, CAFile: "foo.ca"}
 	if _, err := NewGRPCClientConnection(clientConfig); err == nil {
 		t.Fatal("Expected error with missing CA file")
 	}
 }
 
 func TestInvalidServerTLSFiles(t *testing.T) {
-	serverConfig := GRPCServerParam{"localhost:0", true, "invalid.ca", "invalid.key", false}
+	serverConfig := GRPCServerParam{Endpoint: "localhost:0", TLS: true, CertFile: "invalid.ca", KeyFile: "invalid.key"}
 	srv, err := NewGRPCServer(serverConfig)
 	if err != nil {
 		t.Fatal(err)
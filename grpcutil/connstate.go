@@ -0,0 +1,248 @@
+package grpcutil
+
+//
+//Copyright 2019 Telenor Digital AS
+//
+//Licensed under the Apache License, Version 2.0 (the "License");
+//you may not use this file except in compliance with the License.
+//You may obtain a copy of the License at
+//
+//http://www.apache.org/licenses/LICENSE-2.0
+//
+//Unless required by applicable law or agreed to in writing, software
+//distributed under the License is distributed on an "AS IS" BASIS,
+//WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//See the License for the specific language governing permissions and
+//limitations under the License.
+//
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/balancer"
+	"google.golang.org/grpc/connectivity"
+	"google.golang.org/grpc/resolver"
+	"google.golang.org/grpc/serviceconfig"
+)
+
+// WaitForReady connects the client connection and waits until it is ready.
+// Client connections connect lazily so use this at startup to check that
+// the server is reachable. An error is returned if the context is done
+// before the connection is ready or if the connection is closed.
+func WaitForReady(ctx context.Context, conn *grpc.ClientConn) error {
+	conn.Connect()
+	for {
+		state := conn.GetState()
+		switch state {
+		case connectivity.Ready:
+			return nil
+		case connectivity.Shutdown:
+			return errors.New("connection is closed")
+		case connectivity.Idle:
+			conn.Connect()
+		}
+		if !conn.WaitForStateChange(ctx, state) {
+			return fmt.Errorf("connection to %s is not ready (%s): %w", conn.Target(), state, ctx.Err())
+		}
+	}
+}
+
+// WatchConnectionState calls the callback with the current state of the
+// connection and then for every state change. It doesn't connect the
+// connection. WatchConnectionState returns when the context is done or when
+// the connection is closed. The callback is called with the Shutdown state
+// when the connection is closed.
+func WatchConnectionState(ctx context.Context, conn *grpc.ClientConn, callback func(state connectivity.State)) {
+	state := conn.GetState()
+	callback(state)
+	for state != connectivity.Shutdown {
+		if !conn.WaitForStateChange(ctx, state) {
+			return
+		}
+		state = conn.GetState()
+		callback(state)
+	}
+}
+
+// MonitorConnectionState exports the state of the connection in the
+// grpcutil_client_connections gauge and counts state changes in the
+// grpcutil_client_connection_state_changes_total counter. Both metrics are
+// labelled with the endpoint and the state so connections that flap between
+// ready and failing show up on dashboards. MonitorConnectionState returns
+// when the context is done or when the connection is closed. Clients created
+// with NewGRPCClientConnection export the state of each backend address in
+// the same metrics when metrics are enabled.
+func MonitorConnectionState(ctx context.Context, conn *grpc.ClientConn, endpoint string) {
+	monitor := &stateMonitor{mutex: &sync.Mutex{}, endpoint: endpoint, current: connectivity.Shutdown}
+	WatchConnectionState(ctx, conn, monitor.update)
+	monitor.update(connectivity.Shutdown)
+}
+
+// stateMonitor exports the state of a connection or subchannel
+type stateMonitor struct {
+	mutex    *sync.Mutex
+	endpoint string
+	current  connectivity.State
+}
+
+// update changes the exported state. The state is removed from the gauge
+// when it changes to Shutdown.
+func (s *stateMonitor) update(state connectivity.State) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if state == s.current {
+		return
+	}
+	if s.current != connectivity.Shutdown {
+		connectionStateGauge.WithLabelValues(s.endpoint, s.current.String()).Dec()
+		connectionStateCounter.WithLabelValues(s.endpoint, state.String()).Inc()
+	}
+	if state != connectivity.Shutdown {
+		connectionStateGauge.WithLabelValues(s.endpoint, state.String()).Inc()
+	}
+	s.current = state
+}
+
+// monitoredBalancerName is the load balancing policy that exports the state
+// of each subchannel. It wraps the policy in the childPolicy field of the
+// configuration.
+const monitoredBalancerName = "grpcutil_monitored"
+
+func init() {
+	balancer.Register(monitoredBuilder{})
+}
+
+type monitoredConfig struct {
+	serviceconfig.LoadBalancingConfig
+	ChildPolicy string `json:"childPolicy"`
+	childConfig serviceconfig.LoadBalancingConfig
+}
+
+type monitoredBuilder struct{}
+
+func (monitoredBuilder) Name() string {
+	return monitoredBalancerName
+}
+
+func (monitoredBuilder) Build(cc balancer.ClientConn, opts balancer.BuildOptions) balancer.Balancer {
+	return &monitoredBalancer{ClientConn: cc, opts: opts, mutex: &sync.Mutex{}, monitors: make(map[*stateMonitor]bool)}
+}
+
+func (monitoredBuilder) ParseConfig(js json.RawMessage) (serviceconfig.LoadBalancingConfig, error) {
+	config := &monitoredConfig{}
+	if err := json.Unmarshal(js, config); err != nil {
+		return nil, err
+	}
+	if config.ChildPolicy == "" {
+		config.ChildPolicy = PickFirst
+	}
+	builder := balancer.Get(config.ChildPolicy)
+	if builder == nil {
+		return nil, fmt.Errorf("unknown load balancing policy: %s", config.ChildPolicy)
+	}
+	if parser, ok := builder.(balancer.ConfigParser); ok {
+		childConfig, err := parser.ParseConfig(json.RawMessage("{}"))
+		if err != nil {
+			return nil, err
+		}
+		config.childConfig = childConfig
+	}
+	return config, nil
+}
+
+// monitoredBalancer passes everything on to the child policy and exports the
+// state of the subchannels the child creates. Subchannels are labelled with
+// their address. The pick_first policy uses a single subchannel for every
+// address so it is labelled with the list of addresses.
+type monitoredBalancer struct {
+	balancer.ClientConn
+	opts     balancer.BuildOptions
+	child    balancer.Balancer
+	mutex    *sync.Mutex
+	monitors map[*stateMonitor]bool
+}
+
+func (m *monitoredBalancer) NewSubConn(addrs []resolver.Address, opts balancer.NewSubConnOptions) (balancer.SubConn, error) {
+	var names []string
+	for _, addr := range addrs {
+		names = append(names, addr.Addr)
+	}
+	monitor := &stateMonitor{mutex: &sync.Mutex{}, endpoint: strings.Join(names, ","), current: connectivity.Shutdown}
+	listener := opts.StateListener
+	opts.StateListener = func(state balancer.SubConnState) {
+		m.update(monitor, state.ConnectivityState)
+		if listener != nil {
+			listener(state)
+		}
+	}
+	sc, err := m.ClientConn.NewSubConn(addrs, opts)
+	if err != nil {
+		return nil, err
+	}
+	// Subchannels start out idle but the first state update comes when they
+	// start connecting
+	m.update(monitor, connectivity.Idle)
+	return sc, nil
+}
+
+// update updates the subchannel state and keeps track of the subchannels
+// that haven't been shut down
+func (m *monitoredBalancer) update(monitor *stateMonitor, state connectivity.State) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	if state == connectivity.Shutdown {
+		delete(m.monitors, monitor)
+	} else {
+		m.monitors[monitor] = true
+	}
+	monitor.update(state)
+}
+
+func (m *monitoredBalancer) UpdateClientConnState(state balancer.ClientConnState) error {
+	config, ok := state.BalancerConfig.(*monitoredConfig)
+	if !ok {
+		return fmt.Errorf("invalid balancer configuration: %T", state.BalancerConfig)
+	}
+	if m.child == nil {
+		m.child = balancer.Get(config.ChildPolicy).Build(m, m.opts)
+	}
+	state.BalancerConfig = config.childConfig
+	return m.child.UpdateClientConnState(state)
+}
+
+func (m *monitoredBalancer) ResolverError(err error) {
+	if m.child != nil {
+		m.child.ResolverError(err)
+	}
+}
+
+func (m *monitoredBalancer) UpdateSubConnState(sc balancer.SubConn, state balancer.SubConnState) {
+	if m.child != nil {
+		m.child.UpdateSubConnState(sc, state)
+	}
+}
+
+func (m *monitoredBalancer) ExitIdle() {
+	if idler, ok := m.child.(balancer.ExitIdler); ok {
+		idler.ExitIdle()
+	}
+}
+
+// Close closes the child policy. Subchannels aren't always shut down when
+// the client connection is closed so they are removed from the metrics here.
+func (m *monitoredBalancer) Close() {
+	if m.child != nil {
+		m.child.Close()
+	}
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	for monitor := range m.monitors {
+		monitor.update(connectivity.Shutdown)
+	}
+	m.monitors = make(map[*stateMonitor]bool)
+}
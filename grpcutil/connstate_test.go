@@ -0,0 +1,178 @@
+package grpcutil
+
+//
+//Copyright 2019 Telenor Digital AS
+//
+//Licensed under the Apache License, Version 2.0 (the "License");
+//you may not use this file except in compliance with the License.
+//You may obtain a copy of the License at
+//
+//http://www.apache.org/licenses/LICENSE-2.0
+//
+//Unless required by applicable law or agreed to in writing, software
+//distributed under the License is distributed on an "AS IS" BASIS,
+//WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//See the License for the specific language governing permissions and
+//limitations under the License.
+//
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/connectivity"
+)
+
+// connectionGauge returns the value of the connection state gauge
+func connectionGauge(t *testing.T, endpoint string, state connectivity.State) float64 {
+	families, err := prometheus.DefaultGatherer.Gather()
+	require.NoError(t, err)
+	for _, family := range families {
+		if family.GetName() != "grpcutil_client_connections" {
+			continue
+		}
+		for _, metric := range family.GetMetric() {
+			labels := make(map[string]string)
+			for _, label := range metric.GetLabel() {
+				labels[label.GetName()] = label.GetValue()
+			}
+			if labels["endpoint"] == endpoint && labels["state"] == state.String() {
+				return metric.GetGauge().GetValue()
+			}
+		}
+	}
+	return 0
+}
+
+func TestWaitForReady(t *testing.T) {
+	assert := require.New(t)
+
+	_, conn := NewTestServer(t, GRPCServerParam{}, GRPCClientParam{}, func(s *grpc.Server) {}, nil)
+	assert.Equal(connectivity.Idle, conn.GetState())
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	assert.NoError(WaitForReady(ctx, conn))
+	assert.Equal(connectivity.Ready, conn.GetState())
+
+	// Nothing listens on the port of a closed listener
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.NoError(err)
+	endpoint := listener.Addr().String()
+	listener.Close()
+
+	conn, err = NewGRPCClientConnection(GRPCClientParam{ServerEndpoint: endpoint, Metrics: true})
+	assert.NoError(err)
+	shortCtx, shortCancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer shortCancel()
+	err = WaitForReady(shortCtx, conn)
+	assert.ErrorIs(err, context.DeadlineExceeded)
+
+	// Connections are monitored when metrics are enabled
+	notReady := func() float64 {
+		return connectionGauge(t, endpoint, connectivity.Idle) +
+			connectionGauge(t, endpoint, connectivity.Connecting) +
+			connectionGauge(t, endpoint, connectivity.TransientFailure)
+	}
+	assert.Eventually(func() bool { return notReady() == 1 }, 5*time.Second, 10*time.Millisecond)
+
+	conn.Close()
+	assert.Error(WaitForReady(ctx, conn))
+	assert.Eventually(func() bool { return notReady() == 0 }, 5*time.Second, 10*time.Millisecond)
+}
+
+func TestConnectionStateMonitoring(t *testing.T) {
+	assert := require.New(t)
+
+	_, conn := NewTestServer(t, GRPCServerParam{}, GRPCClientParam{}, func(s *grpc.Server) {}, nil)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	states := make(chan connectivity.State, 10)
+	watchDone := make(chan struct{})
+	go func() {
+		WatchConnectionState(ctx, conn, func(state connectivity.State) { states <- state })
+		close(watchDone)
+	}()
+	monitorDone := make(chan struct{})
+	go func() {
+		MonitorConnectionState(ctx, conn, "monitor-test")
+		close(monitorDone)
+	}()
+
+	assert.Equal(connectivity.Idle, <-states)
+	assert.Eventually(func() bool {
+		return connectionGauge(t, "monitor-test", connectivity.Idle) == 1
+	}, 5*time.Second, 10*time.Millisecond)
+
+	assert.NoError(WaitForReady(ctx, conn))
+	assert.Eventually(func() bool {
+		return connectionGauge(t, "monitor-test", connectivity.Ready) == 1
+	}, 5*time.Second, 10*time.Millisecond)
+	assert.Equal(float64(0), connectionGauge(t, "monitor-test", connectivity.Idle))
+
+	// The watchers return when the connection is closed
+	conn.Close()
+	<-watchDone
+	<-monitorDone
+	var last connectivity.State
+	for len(states) > 0 {
+		last = <-states
+	}
+	assert.Equal(connectivity.Shutdown, last)
+	assert.Equal(float64(0), connectionGauge(t, "monitor-test", connectivity.Ready))
+}
+
+func TestBackendStateMonitoring(t *testing.T) {
+	assert := require.New(t)
+
+	var callsA, callsB int64
+	serverA := newCountingServer(t, &callsA)
+	serverB := newCountingServer(t, &callsB)
+	endpointA := serverA.ListenAddress().String()
+	endpointB := serverB.ListenAddress().String()
+
+	conn, err := NewGRPCClientConnection(GRPCClientParam{
+		ServerEndpoint:      endpointA + "," + endpointB,
+		LoadBalancingPolicy: RoundRobin,
+		Metrics:             true,
+	})
+	assert.NoError(err)
+	defer conn.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	assert.NoError(WaitForReady(ctx, conn))
+
+	// Each backend is labelled with its own address
+	assert.Eventually(func() bool {
+		return connectionGauge(t, endpointA, connectivity.Ready) == 1 &&
+			connectionGauge(t, endpointB, connectivity.Ready) == 1
+	}, 5*time.Second, 10*time.Millisecond)
+	assert.Equal(float64(0), connectionGauge(t, endpointA+","+endpointB, connectivity.Ready))
+
+	// The state of the backend that goes down changes while the other
+	// backend stays ready
+	serverB.Stop()
+	notReady := func(endpoint string) float64 {
+		return connectionGauge(t, endpoint, connectivity.Idle) +
+			connectionGauge(t, endpoint, connectivity.Connecting) +
+			connectionGauge(t, endpoint, connectivity.TransientFailure)
+	}
+	assert.Eventually(func() bool {
+		return connectionGauge(t, endpointB, connectivity.Ready) == 0 && notReady(endpointB) == 1
+	}, 5*time.Second, 10*time.Millisecond)
+	assert.Equal(float64(1), connectionGauge(t, endpointA, connectivity.Ready))
+	assert.Equal(connectivity.Ready, conn.GetState())
+
+	// The backends are removed from the gauge when the connection is closed
+	conn.Close()
+	assert.Eventually(func() bool {
+		return connectionGauge(t, endpointA, connectivity.Ready) == 0 && notReady(endpointB) == 0
+	}, 5*time.Second, 10*time.Millisecond)
+}
@@ -0,0 +1,217 @@
+package grpcutil
+
+//
+//Copyright 2019 Telenor Digital AS
+//
+//Licensed under the Apache License, Version 2.0 (the "License");
+//you may not use this file except in compliance with the License.
+//You may obtain a copy of the License at
+//
+//http://www.apache.org/licenses/LICENSE-2.0
+//
+//Unless required by applicable law or agreed to in writing, software
+//distributed under the License is distributed on an "AS IS" BASIS,
+//WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//See the License for the specific language governing permissions and
+//limitations under the License.
+//
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"log"
+	"math/big"
+	"net"
+	"os"
+	"sync"
+	"time"
+)
+
+const (
+	// devCertValidity is the validity period for development certificates
+	devCertValidity = 30 * 24 * time.Hour
+
+	// devCertLabel is the certificate file label for development
+	// certificates in the expiry metric
+	devCertLabel = "development"
+)
+
+// devSubjectAltNames returns the host names and IP addresses for the
+// development certificate. Local names and loopback addresses are always
+// included. If the server listens on all interfaces every interface address
+// is included. The address is nil when the listener isn't known and the host
+// from the endpoint is used instead.
+func devSubjectAltNames(endpoint string, addr net.Addr) ([]string, []net.IP) {
+	names := []string{"localhost"}
+	if hostname, err := os.Hostname(); err == nil {
+		names = append(names, hostname)
+	}
+	ips := []net.IP{net.IPv4(127, 0, 0, 1), net.IPv6loopback}
+
+	if host, _, err := net.SplitHostPort(endpoint); err == nil && host != "" {
+		if ip := net.ParseIP(host); ip != nil {
+			ips = append(ips, ip)
+		} else {
+			names = append(names, host)
+		}
+	}
+
+	tcpAddr, ok := addr.(*net.TCPAddr)
+	if !ok {
+		return names, ips
+	}
+	if !tcpAddr.IP.IsUnspecified() {
+		return names, append(ips, tcpAddr.IP)
+	}
+	interfaceAddrs, err := net.InterfaceAddrs()
+	if err != nil {
+		log.Printf("Unable to list interface addresses for development certificate: %v", err)
+		return names, ips
+	}
+	for _, a := range interfaceAddrs {
+		if ipNet, ok := a.(*net.IPNet); ok {
+			ips = append(ips, ipNet.IP)
+		}
+	}
+	return names, ips
+}
+
+func randomSerial() (*big.Int, error) {
+	return rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+}
+
+// devAuthority is the development CA. It is generated once per process so
+// every server with development certificates uses the same CA and clients
+// keep working when another server writes the CA file.
+type devAuthority struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+	pem  []byte // PEM-encoded CA certificate
+}
+
+var (
+	devCAMutex = &sync.Mutex{}
+	devCA      *devAuthority
+)
+
+// developmentCA returns the development CA for the process. The CA is
+// generated on first use and again when half of its validity period has
+// passed. The key only lives in memory.
+func developmentCA() (*devAuthority, error) {
+	devCAMutex.Lock()
+	defer devCAMutex.Unlock()
+	if devCA != nil && time.Until(devCA.cert.NotAfter) > devCertValidity/2 {
+		return devCA, nil
+	}
+	now := time.Now()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	serial, err := randomSerial()
+	if err != nil {
+		return nil, err
+	}
+	template := &x509.Certificate{
+		SerialNumber:          serial,
+		Subject:               pkix.Name{CommonName: "grpcutil development CA"},
+		NotBefore:             now.Add(-time.Hour),
+		NotAfter:              now.Add(devCertValidity),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		return nil, err
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		return nil, err
+	}
+	devCA = &devAuthority{
+		cert: cert,
+		key:  key,
+		pem:  pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}),
+	}
+	return devCA, nil
+}
+
+// issue generates a server certificate signed by the CA
+func (ca *devAuthority) issue(names []string, ips []net.IP) (tls.Certificate, error) {
+	now := time.Now()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	serial, err := randomSerial()
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	template := &x509.Certificate{
+		SerialNumber: serial,
+		Subject:      pkix.Name{CommonName: names[0]},
+		NotBefore:    now.Add(-time.Hour),
+		NotAfter:     ca.cert.NotAfter,
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		DNSNames:     names,
+		IPAddresses:  ips,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, ca.cert, &key.PublicKey, ca.key)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	leaf, err := x509.ParseCertificate(der)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	return tls.Certificate{
+		Certificate: [][]byte{der},
+		PrivateKey:  key,
+		Leaf:        leaf,
+	}, nil
+}
+
+// writeCAFile writes the CA certificate to the file unless the file already
+// holds it
+func (ca *devAuthority) writeCAFile(fileName string) error {
+	if existing, err := os.ReadFile(fileName); err == nil && bytes.Equal(existing, ca.pem) {
+		return nil
+	}
+	return os.WriteFile(fileName, ca.pem, 0644)
+}
+
+// devCertificate generates a development certificate for the server and
+// writes the CA certificate to the DevCAFile parameter so clients can use it
+// as their CA file. Every server in the process uses the same CA. The
+// certificate only lives in memory and can't be reloaded.
+func devCertificate(config GRPCServerParam, addr net.Addr) (*certReloader, error) {
+	if config.DevCAFile == "" {
+		return nil, errors.New("missing CA file parameter for development certificates")
+	}
+	ca, err := developmentCA()
+	if err != nil {
+		return nil, err
+	}
+	names, ips := devSubjectAltNames(config.Endpoint, addr)
+	cert, err := ca.issue(names, ips)
+	if err != nil {
+		return nil, err
+	}
+	if err := ca.writeCAFile(config.DevCAFile); err != nil {
+		return nil, err
+	}
+	log.Printf("Generated development certificate for %v %v. CA certificate written to %s", names, ips, config.DevCAFile)
+	certExpiryGauge.WithLabelValues(devCertLabel).Set(float64(cert.Leaf.NotAfter.Unix()))
+	return &certReloader{
+		mutex: &sync.RWMutex{},
+		cert:  &cert,
+	}, nil
+}
@@ -0,0 +1,111 @@
+package grpcutil
+
+//
+//Copyright 2019 Telenor Digital AS
+//
+//Licensed under the Apache License, Version 2.0 (the "License");
+//you may not use this file except in compliance with the License.
+//You may obtain a copy of the License at
+//
+//http://www.apache.org/licenses/LICENSE-2.0
+//
+//Unless required by applicable law or agreed to in writing, software
+//distributed under the License is distributed on an "AS IS" BASIS,
+//WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//See the License for the specific language governing permissions and
+//limitations under the License.
+//
+import (
+	"context"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/health/grpc_health_v1"
+)
+
+func TestDevCertificate(t *testing.T) {
+	assert := require.New(t)
+
+	caFile := filepath.Join(t.TempDir(), "dev-ca.crt")
+	server, err := NewGRPCServer(GRPCServerParam{Endpoint: "127.0.0.1:0", TLS: true, DevCerts: true, DevCAFile: caFile, Health: true})
+	assert.NoError(err)
+	assert.NoError(server.Launch(func(s *grpc.Server) {}, time.Second))
+	defer server.Stop()
+
+	port := server.ListenAddress().(*net.TCPAddr).Port
+	for _, endpoint := range []string{server.ListenAddress().String(), fmt.Sprintf("localhost:%d", port)} {
+		conn, err := NewGRPCClientConnection(GRPCClientParam{ServerEndpoint: endpoint, TLS: true, CAFile: caFile})
+		assert.NoError(err)
+		defer conn.Close()
+
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		_, err = grpc_health_v1.NewHealthClient(conn).Check(ctx, &grpc_health_v1.HealthCheckRequest{})
+		assert.NoError(err, endpoint)
+	}
+
+	// The certificate is only in memory
+	assert.Error(server.ReloadCertificates())
+
+	// Other servers in the process use the same CA so the CA file is
+	// still valid for the first server
+	caPEM, err := os.ReadFile(caFile)
+	assert.NoError(err)
+	other, err := NewGRPCServer(GRPCServerParam{Endpoint: "127.0.0.1:0", TLS: true, DevCerts: true, DevCAFile: caFile, Health: true})
+	assert.NoError(err)
+	assert.NoError(other.Launch(func(s *grpc.Server) {}, time.Second))
+	defer other.Stop()
+	otherPEM, err := os.ReadFile(caFile)
+	assert.NoError(err)
+	assert.Equal(caPEM, otherPEM)
+
+	for _, endpoint := range []string{server.ListenAddress().String(), other.ListenAddress().String()} {
+		conn, err := NewGRPCClientConnection(GRPCClientParam{ServerEndpoint: endpoint, TLS: true, CAFile: caFile})
+		assert.NoError(err)
+		defer conn.Close()
+
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		_, err = grpc_health_v1.NewHealthClient(conn).Check(ctx, &grpc_health_v1.HealthCheckRequest{})
+		assert.NoError(err, endpoint)
+	}
+}
+
+func TestDevSubjectAltNames(t *testing.T) {
+	assert := require.New(t)
+
+	names, ips := devSubjectAltNames("example.com:0", &net.TCPAddr{IP: net.ParseIP("10.1.2.3")})
+	assert.Contains(names, "localhost")
+	assert.Contains(names, "example.com")
+	assert.True(containsIP(ips, net.ParseIP("10.1.2.3")))
+	assert.True(containsIP(ips, net.ParseIP("::1")))
+
+	// All interface addresses are included for wildcard listeners
+	_, ips = devSubjectAltNames(":0", &net.TCPAddr{IP: net.IPv4zero})
+	interfaceAddrs, err := net.InterfaceAddrs()
+	assert.NoError(err)
+	for _, a := range interfaceAddrs {
+		if ipNet, ok := a.(*net.IPNet); ok {
+			assert.True(containsIP(ips, ipNet.IP), ipNet.IP.String())
+		}
+	}
+
+	// The CA file is required
+	_, err = GetServerOpts(GRPCServerParam{Endpoint: "127.0.0.1:0", TLS: true, DevCerts: true})
+	assert.Error(err)
+}
+
+func containsIP(ips []net.IP, ip net.IP) bool {
+	for _, i := range ips {
+		if i.Equal(ip) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,95 @@
+package grpcutil
+
+//
+//Copyright 2019 Telenor Digital AS
+//
+//Licensed under the Apache License, Version 2.0 (the "License");
+//you may not use this file except in compliance with the License.
+//You may obtain a copy of the License at
+//
+//http://www.apache.org/licenses/LICENSE-2.0
+//
+//Unless required by applicable law or agreed to in writing, software
+//distributed under the License is distributed on an "AS IS" BASIS,
+//WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//See the License for the specific language governing permissions and
+//limitations under the License.
+//
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/health"
+	"google.golang.org/grpc/health/grpc_health_v1"
+)
+
+// launchHealthServer launches a server with a health service. Unary calls are
+// delayed by the delay parameter.
+func launchHealthServer(t *testing.T, delay time.Duration) (GRPCServer, *health.Server, grpc_health_v1.HealthClient) {
+	server, err := NewGRPCServer(GRPCServerParam{Endpoint: "127.0.0.1:0"})
+	require.NoError(t, err)
+
+	healthServer := health.NewServer()
+	server.SetHealthServer(healthServer)
+	require.NoError(t, server.LaunchWithOpts(func(s *grpc.Server) {
+		grpc_health_v1.RegisterHealthServer(s, healthServer)
+	}, 100*time.Millisecond, []grpc.ServerOption{
+		grpc.UnaryInterceptor(func(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+			time.Sleep(delay)
+			return handler(ctx, req)
+		}),
+	}))
+
+	conn, err := NewGRPCClientConnection(GRPCClientParam{ServerEndpoint: server.ListenAddress().String()})
+	require.NoError(t, err)
+	t.Cleanup(func() { conn.Close() })
+	return server, healthServer, grpc_health_v1.NewHealthClient(conn)
+}
+
+func TestGracefulStop(t *testing.T) {
+	assert := require.New(t)
+
+	server, healthServer, client := launchHealthServer(t, 200*time.Millisecond)
+
+	result := make(chan error)
+	go func() {
+		_, err := client.Check(context.Background(), &grpc_health_v1.HealthCheckRequest{})
+		result <- err
+	}()
+	time.Sleep(50 * time.Millisecond)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	assert.NoError(server.GracefulStop(ctx))
+	assert.NoError(<-result, "In-flight call should complete")
+
+	res, err := healthServer.Check(context.Background(), &grpc_health_v1.HealthCheckRequest{})
+	assert.NoError(err)
+	assert.Equal(grpc_health_v1.HealthCheckResponse_NOT_SERVING, res.Status)
+}
+
+func TestGracefulStopTimeout(t *testing.T) {
+	assert := require.New(t)
+
+	server, _, client := launchHealthServer(t, 0)
+
+	// Watch streams never complete on their own
+	stream, err := client.Watch(context.Background(), &grpc_health_v1.HealthCheckRequest{})
+	assert.NoError(err)
+	_, err = stream.Recv()
+	assert.NoError(err)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	assert.ErrorIs(server.GracefulStop(ctx), context.DeadlineExceeded)
+}
+
+func TestGracefulStopNotStarted(t *testing.T) {
+	server, err := NewGRPCServer(GRPCServerParam{Endpoint: "127.0.0.1:0"})
+	require.NoError(t, err)
+	require.NoError(t, server.GracefulStop(context.Background()))
+	require.NoError(t, server.Wait())
+}
@@ -0,0 +1,117 @@
+package grpcutil
+
+//
+//Copyright 2019 Telenor Digital AS
+//
+//Licensed under the Apache License, Version 2.0 (the "License");
+//you may not use this file except in compliance with the License.
+//You may obtain a copy of the License at
+//
+//http://www.apache.org/licenses/LICENSE-2.0
+//
+//Unless required by applicable law or agreed to in writing, software
+//distributed under the License is distributed on an "AS IS" BASIS,
+//WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//See the License for the specific language governing permissions and
+//limitations under the License.
+//
+import (
+	"context"
+	"net"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/lab5e/gotoolbox/metrics"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/health/grpc_health_v1"
+	"google.golang.org/grpc/status"
+)
+
+func TestBuiltinHealthService(t *testing.T) {
+	assert := require.New(t)
+
+	server, err := NewGRPCServer(GRPCServerParam{Endpoint: "127.0.0.1:0", Health: true})
+	assert.NoError(err)
+	assert.NoError(server.Launch(func(s *grpc.Server) {}, 100*time.Millisecond))
+	defer server.Stop()
+
+	conn, err := NewGRPCClientConnection(GRPCClientParam{ServerEndpoint: server.ListenAddress().String()})
+	assert.NoError(err)
+	defer conn.Close()
+	client := grpc_health_v1.NewHealthClient(conn)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	check := func(service string) grpc_health_v1.HealthCheckResponse_ServingStatus {
+		res, err := client.Check(ctx, &grpc_health_v1.HealthCheckRequest{Service: service})
+		assert.NoError(err)
+		return res.Status
+	}
+
+	assert.Equal(grpc_health_v1.HealthCheckResponse_SERVING, check(""))
+	assert.True(server.Serving())
+
+	server.SetServingStatus("", grpc_health_v1.HealthCheckResponse_NOT_SERVING)
+	assert.Equal(grpc_health_v1.HealthCheckResponse_NOT_SERVING, check(""))
+	assert.False(server.Serving())
+
+	_, err = client.Check(ctx, &grpc_health_v1.HealthCheckRequest{Service: "some.Service"})
+	assert.Equal(codes.NotFound, status.Code(err))
+	server.SetServingStatus("some.Service", grpc_health_v1.HealthCheckResponse_SERVING)
+	assert.Equal(grpc_health_v1.HealthCheckResponse_SERVING, check("some.Service"))
+}
+
+func TestMonitoringFollowsHealth(t *testing.T) {
+	assert := require.New(t)
+
+	server, err := NewGRPCServer(GRPCServerParam{Endpoint: "127.0.0.1:0", Health: true})
+	assert.NoError(err)
+	defer server.Stop()
+
+	mon, err := metrics.NewMonitoringServer("127.0.0.1:0")
+	assert.NoError(err)
+	assert.NoError(mon.Start())
+	defer mon.Shutdown()
+	mon.SetHealthCheck(server.Serving)
+
+	healthz := func() int {
+		res, err := http.Get(mon.ServerURL() + "/healthz")
+		assert.NoError(err)
+		res.Body.Close()
+		return res.StatusCode
+	}
+	// The server isn't healthy until it is serving
+	assert.Equal(http.StatusServiceUnavailable, healthz())
+	assert.NoError(server.Launch(func(s *grpc.Server) {}, time.Second))
+	assert.Equal(http.StatusOK, healthz())
+	server.SetServingStatus("", grpc_health_v1.HealthCheckResponse_NOT_SERVING)
+	assert.Equal(http.StatusServiceUnavailable, healthz())
+	server.SetServingStatus("", grpc_health_v1.HealthCheckResponse_SERVING)
+	assert.Equal(http.StatusOK, healthz())
+
+	// Stopped servers aren't healthy
+	server.Stop()
+	assert.Equal(http.StatusServiceUnavailable, healthz())
+	assert.NoError(server.Wait())
+	assert.Equal(http.StatusServiceUnavailable, healthz())
+}
+
+func TestServingAfterFailedStart(t *testing.T) {
+	assert := require.New(t)
+
+	// Serve fails when the listener is closed
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.NoError(err)
+	listener.Close()
+
+	server, err := NewGRPCServerWithListener(GRPCServerParam{Health: true}, listener)
+	assert.NoError(err)
+	server.Launch(func(s *grpc.Server) {}, time.Second)
+	<-server.Done()
+	assert.Error(server.Err())
+	assert.False(server.Serving())
+}
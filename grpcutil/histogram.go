@@ -0,0 +1,38 @@
+package grpcutil
+
+//
+//Copyright 2019 Telenor Digital AS
+//
+//Licensed under the Apache License, Version 2.0 (the "License");
+//you may not use this file except in compliance with the License.
+//You may obtain a copy of the License at
+//
+//http://www.apache.org/licenses/LICENSE-2.0
+//
+//Unless required by applicable law or agreed to in writing, software
+//distributed under the License is distributed on an "AS IS" BASIS,
+//WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//See the License for the specific language governing permissions and
+//limitations under the License.
+//
+import (
+	"sync"
+
+	grpc_prometheus "github.com/grpc-ecosystem/go-grpc-prometheus"
+)
+
+// histogramOnce turns on the histograms once. grpc_prometheus doesn't guard
+// the switch so enabling the histograms twice is a data race too.
+var histogramOnce = &sync.Once{}
+
+// EnableHandlingTimeHistograms turns on the grpc_server_handling_seconds and
+// grpc_client_handling_seconds histograms for every server and client in the
+// process with metrics enabled. The grpc_prometheus interceptors read the
+// switch without synchronization so call this at startup before any servers
+// or clients are created.
+func EnableHandlingTimeHistograms() {
+	histogramOnce.Do(func() {
+		grpc_prometheus.EnableHandlingTimeHistogram()
+		grpc_prometheus.EnableClientHandlingTimeHistogram()
+	})
+}
@@ -0,0 +1,151 @@
+package grpcutil
+
+//
+//Copyright 2019 Telenor Digital AS
+//
+//Licensed under the Apache License, Version 2.0 (the "License");
+//you may not use this file except in compliance with the License.
+//You may obtain a copy of the License at
+//
+//http://www.apache.org/licenses/LICENSE-2.0
+//
+//Unless required by applicable law or agreed to in writing, software
+//distributed under the License is distributed on an "AS IS" BASIS,
+//WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//See the License for the specific language governing permissions and
+//limitations under the License.
+//
+import (
+	"context"
+	"errors"
+	"log"
+	"net/http"
+	"sync"
+
+	"github.com/lab5e/gotoolbox/rest"
+	"golang.org/x/net/http2"
+	"golang.org/x/net/http2/h2c"
+	"google.golang.org/grpc"
+)
+
+// httpMux routes gRPC requests to the gRPC server and all other requests to
+// the HTTP handler. In-flight requests are tracked so the server can be
+// drained; the gRPC server's own GracefulStop doesn't support requests
+// served through ServeHTTP.
+type httpMux struct {
+	grpcServer *grpc.Server
+	handler    http.Handler
+	mutex      *sync.Mutex
+	draining   bool
+	inFlight   *sync.WaitGroup
+}
+
+func newHTTPMux(grpcServer *grpc.Server, handler http.Handler) *httpMux {
+	return &httpMux{
+		grpcServer: grpcServer,
+		handler:    handler,
+		mutex:      &sync.Mutex{},
+		inFlight:   &sync.WaitGroup{},
+	}
+}
+
+func (m *httpMux) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	m.mutex.Lock()
+	if m.draining {
+		m.mutex.Unlock()
+		http.Error(w, "server is shutting down", http.StatusServiceUnavailable)
+		return
+	}
+	m.inFlight.Add(1)
+	m.mutex.Unlock()
+	defer m.inFlight.Done()
+
+	if rest.IsGRPCRequest(r) {
+		m.grpcServer.ServeHTTP(w, r)
+		return
+	}
+	m.handler.ServeHTTP(w, r)
+}
+
+// drain rejects new requests and waits for the in-flight requests to
+// complete.
+func (m *httpMux) drain(ctx context.Context) error {
+	m.mutex.Lock()
+	m.draining = true
+	m.mutex.Unlock()
+
+	done := make(chan struct{})
+	go func() {
+		m.inFlight.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// http2Server returns the HTTP/2 server settings for the connection
+// parameters. gRPC requests served through the HTTP server don't use the
+// gRPC server's transport so the settings are mapped onto the HTTP/2 server
+// where possible. Only the maximum connection idle time can be mapped, the
+// HTTP/2 server doesn't ping clients and has no maximum connection age.
+func http2Server(config GRPCServerParam) *http2.Server {
+	return &http2.Server{
+		IdleTimeout: config.MaxConnectionIdle,
+	}
+}
+
+// serveHTTP serves both gRPC and HTTP requests on the listener. With TLS the
+// protocol is negotiated through ALPN, without TLS HTTP/2 requests are served
+// as h2c.
+func (g *grpcServer) serveHTTP(server *grpc.Server, handler http.Handler) error {
+	if g.config.MaxConnectionAge > 0 {
+		log.Printf("The maximum connection age isn't supported when gRPC and HTTP share the listener")
+	}
+	mux := newHTTPMux(server, handler)
+	httpServer := &http.Server{Handler: mux, IdleTimeout: g.config.MaxConnectionIdle}
+	if g.config.TLS {
+		certs, err := g.loadCertificates()
+		if err != nil {
+			return err
+		}
+		if httpServer.TLSConfig, err = serverTLSConfig(g.config, certs); err != nil {
+			return err
+		}
+	}
+	// Configuring the HTTP/2 server applies the idle timeout and makes
+	// Shutdown send GOAWAY on the h2c connections as well. It must be done
+	// after the TLS config is set since it adds h2 to the TLS protocols.
+	h2s := http2Server(g.config)
+	if err := http2.ConfigureServer(httpServer, h2s); err != nil {
+		return err
+	}
+	if !g.config.TLS {
+		httpServer.Handler = h2c.NewHandler(mux, h2s)
+	}
+
+	g.mutex.Lock()
+	g.mux = mux
+	g.httpServer = httpServer
+	g.mutex.Unlock()
+	select {
+	case <-g.stop:
+		// Stopped before the HTTP server was set
+		return nil
+	default:
+	}
+
+	var err error
+	if g.config.TLS {
+		err = httpServer.ServeTLS(newReadyListener(g.listener, g.ready), "", "")
+	} else {
+		err = httpServer.Serve(newReadyListener(g.listener, g.ready))
+	}
+	if errors.Is(err, http.ErrServerClosed) {
+		return nil
+	}
+	return err
+}
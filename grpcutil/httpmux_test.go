@@ -0,0 +1,207 @@
+package grpcutil
+
+//
+//Copyright 2019 Telenor Digital AS
+//
+//Licensed under the Apache License, Version 2.0 (the "License");
+//you may not use this file except in compliance with the License.
+//You may obtain a copy of the License at
+//
+//http://www.apache.org/licenses/LICENSE-2.0
+//
+//Unless required by applicable law or agreed to in writing, software
+//distributed under the License is distributed on an "AS IS" BASIS,
+//WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//See the License for the specific language governing permissions and
+//limitations under the License.
+//
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/lab5e/gotoolbox/rest"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/connectivity"
+	"google.golang.org/grpc/health/grpc_health_v1"
+)
+
+func newTestRouter() *rest.ParameterRouter {
+	router := rest.NewParameterRouter()
+	router.AddRoute("/hello/{name}", func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintf(w, "Hello %s", rest.GetPathKey("name", r))
+	})
+	return &router
+}
+
+// checkHTTPAndGRPC does a HTTP request and a gRPC call to the server
+func checkHTTPAndGRPC(t *testing.T, httpClient *http.Client, url string, conn *grpc.ClientConn) {
+	assert := require.New(t)
+
+	resp, err := httpClient.Get(url + "/hello/world")
+	assert.NoError(err)
+	defer resp.Body.Close()
+	buf, err := io.ReadAll(resp.Body)
+	assert.NoError(err)
+	assert.Equal(http.StatusOK, resp.StatusCode)
+	assert.Equal("Hello world", string(buf))
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	res, err := grpc_health_v1.NewHealthClient(conn).Check(ctx, &grpc_health_v1.HealthCheckRequest{})
+	assert.NoError(err)
+	assert.Equal(grpc_health_v1.HealthCheckResponse_SERVING, res.Status)
+}
+
+func TestHTTPAndGRPCOnH2C(t *testing.T) {
+	assert := require.New(t)
+
+	server, err := NewGRPCServer(GRPCServerParam{Endpoint: "127.0.0.1:0", Health: true})
+	assert.NoError(err)
+	server.SetHTTPHandler(newTestRouter())
+	assert.NoError(server.Launch(func(s *grpc.Server) {}, time.Second))
+	defer server.Stop()
+
+	conn, err := NewGRPCClientConnection(GRPCClientParam{ServerEndpoint: server.ListenAddress().String()})
+	assert.NoError(err)
+	defer conn.Close()
+
+	checkHTTPAndGRPC(t, http.DefaultClient, "http://"+server.ListenAddress().String(), conn)
+}
+
+func TestHTTPAndGRPCOnTLS(t *testing.T) {
+	assert := require.New(t)
+
+	ca := newTestCA(t)
+	serverCert, serverKey := ca.Issue("server", x509.ExtKeyUsageServerAuth)
+
+	server, err := NewGRPCServer(GRPCServerParam{Endpoint: "127.0.0.1:0", TLS: true, CertFile: serverCert, KeyFile: serverKey, Health: true})
+	assert.NoError(err)
+	server.SetHTTPHandler(newTestRouter())
+	assert.NoError(server.Launch(func(s *grpc.Server) {}, time.Second))
+	defer server.Stop()
+
+	conn, err := NewGRPCClientConnection(GRPCClientParam{
+		ServerEndpoint:     server.ListenAddress().String(),
+		TLS:                true,
+		CAFile:             ca.CAFile,
+		ServerHostOverride: "localhost",
+	})
+	assert.NoError(err)
+	defer conn.Close()
+
+	pool, err := loadCertPool(ca.CAFile)
+	assert.NoError(err)
+	httpClient := &http.Client{Transport: &http.Transport{TLSClientConfig: &tls.Config{RootCAs: pool}}}
+	checkHTTPAndGRPC(t, httpClient, "https://"+server.ListenAddress().String(), conn)
+}
+
+func TestHTTPMaxConnectionIdle(t *testing.T) {
+	assert := require.New(t)
+
+	server, err := NewGRPCServer(GRPCServerParam{Endpoint: "127.0.0.1:0", Health: true, MaxConnectionIdle: 100 * time.Millisecond})
+	assert.NoError(err)
+	server.SetHTTPHandler(newTestRouter())
+	assert.NoError(server.Launch(func(s *grpc.Server) {}, time.Second))
+	defer server.Stop()
+
+	conn, err := NewGRPCClientConnection(GRPCClientParam{ServerEndpoint: server.ListenAddress().String()})
+	assert.NoError(err)
+	defer conn.Close()
+	checkHTTPAndGRPC(t, http.DefaultClient, "http://"+server.ListenAddress().String(), conn)
+
+	// The HTTP/2 server closes the idle connection
+	assert.Equal(connectivity.Ready, conn.GetState())
+	assert.Eventually(func() bool {
+		return conn.GetState() != connectivity.Ready
+	}, 5*time.Second, 10*time.Millisecond)
+}
+
+func TestGracefulStopWithHTTP(t *testing.T) {
+	assert := require.New(t)
+
+	server, err := NewGRPCServer(GRPCServerParam{Endpoint: "127.0.0.1:0", Health: true})
+	assert.NoError(err)
+	server.SetHTTPHandler(newTestRouter())
+	opts, err := server.ServerOpts()
+	assert.NoError(err)
+	opts = append(opts, grpc.ChainUnaryInterceptor(func(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+		time.Sleep(200 * time.Millisecond)
+		return handler(ctx, req)
+	}))
+	assert.NoError(server.LaunchWithOpts(func(s *grpc.Server) {}, time.Second, opts))
+
+	conn, err := NewGRPCClientConnection(GRPCClientParam{ServerEndpoint: server.ListenAddress().String()})
+	assert.NoError(err)
+	defer conn.Close()
+
+	result := make(chan error)
+	go func() {
+		_, err := grpc_health_v1.NewHealthClient(conn).Check(context.Background(), &grpc_health_v1.HealthCheckRequest{})
+		result <- err
+	}()
+	time.Sleep(50 * time.Millisecond)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	assert.NoError(server.GracefulStop(ctx))
+	assert.NoError(<-result)
+	assert.NoError(server.Wait())
+}
+
+func TestGracefulStopWithHTTPKeepAlive(t *testing.T) {
+	assert := require.New(t)
+
+	server, err := NewGRPCServer(GRPCServerParam{Endpoint: "127.0.0.1:0"})
+	assert.NoError(err)
+	router := newTestRouter()
+	router.AddRoute("/slow", func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(200 * time.Millisecond)
+		fmt.Fprint(w, "done")
+	})
+	server.SetHTTPHandler(router)
+	assert.NoError(server.Launch(func(s *grpc.Server) {}, time.Second))
+
+	url := "http://" + server.ListenAddress().String()
+	httpClient := &http.Client{Transport: &http.Transport{}}
+	resp, err := httpClient.Get(url + "/hello/world")
+	assert.NoError(err)
+	io.Copy(io.Discard, resp.Body)
+	resp.Body.Close()
+
+	// The in-flight request on the kept-alive connection completes
+	result := make(chan string)
+	go func() {
+		resp, err := httpClient.Get(url + "/slow")
+		if err != nil {
+			result <- err.Error()
+			return
+		}
+		defer resp.Body.Close()
+		buf, _ := io.ReadAll(resp.Body)
+		result <- string(buf)
+	}()
+	time.Sleep(50 * time.Millisecond)
+
+	stopped := make(chan error)
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		stopped <- server.GracefulStop(ctx)
+	}()
+	time.Sleep(50 * time.Millisecond)
+
+	// New connections are refused while draining
+	_, err = (&http.Client{Transport: &http.Transport{}}).Get(url + "/hello/world")
+	assert.Error(err)
+
+	assert.Equal("done", <-result)
+	assert.NoError(<-stopped)
+	assert.NoError(server.Wait())
+}
@@ -0,0 +1,201 @@
+package grpcutil
+
+//
+//Copyright 2019 Telenor Digital AS
+//
+//Licensed under the Apache License, Version 2.0 (the "License");
+//you may not use this file except in compliance with the License.
+//You may obtain a copy of the License at
+//
+//http://www.apache.org/licenses/LICENSE-2.0
+//
+//Unless required by applicable law or agreed to in writing, software
+//distributed under the License is distributed on an "AS IS" BASIS,
+//WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//See the License for the specific language governing permissions and
+//limitations under the License.
+//
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"log"
+	"runtime/debug"
+	"sync"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
+)
+
+// ServerInterceptor is a pair of unary and stream server interceptors. Either
+// of them can be nil.
+type ServerInterceptor struct {
+	Unary  grpc.UnaryServerInterceptor
+	Stream grpc.StreamServerInterceptor
+}
+
+// chainInterceptors returns the server options for a list of interceptors
+func chainInterceptors(interceptors []ServerInterceptor) []grpc.ServerOption {
+	var unary []grpc.UnaryServerInterceptor
+	var stream []grpc.StreamServerInterceptor
+	for _, interceptor := range interceptors {
+		if interceptor.Unary != nil {
+			unary = append(unary, interceptor.Unary)
+		}
+		if interceptor.Stream != nil {
+			stream = append(stream, interceptor.Stream)
+		}
+	}
+	var ret []grpc.ServerOption
+	if len(unary) > 0 {
+		unary = append(unary, handlerContextInterceptor.Unary)
+		ret = append(ret, grpc.ChainUnaryInterceptor(unary...))
+	}
+	if len(stream) > 0 {
+		stream = append(stream, handlerContextInterceptor.Stream)
+		ret = append(ret, grpc.ChainStreamInterceptor(stream...))
+	}
+	return ret
+}
+
+type handlerContextKey struct{}
+
+// handlerContext holds the context the handler is called with. Interceptors
+// early in the chain use it to read values that later interceptors add to
+// the context, ie the principal set by the authentication interceptor.
+type handlerContext struct {
+	mutex *sync.Mutex
+	ctx   context.Context
+}
+
+// withHandlerContext returns a context that records the context the handler
+// is called with
+func withHandlerContext(ctx context.Context) (context.Context, *handlerContext) {
+	h := &handlerContext{mutex: &sync.Mutex{}, ctx: ctx}
+	return context.WithValue(ctx, handlerContextKey{}, h), h
+}
+
+// get returns the last recorded context
+func (h *handlerContext) get() context.Context {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	return h.ctx
+}
+
+// recordHandlerContext records the context if an earlier interceptor asked
+// for it
+func recordHandlerContext(ctx context.Context) {
+	if h, ok := ctx.Value(handlerContextKey{}).(*handlerContext); ok {
+		h.mutex.Lock()
+		defer h.mutex.Unlock()
+		h.ctx = ctx
+	}
+}
+
+// handlerContextInterceptor is added last in every chain to record the
+// context. The last chain records the context the handler gets.
+var handlerContextInterceptor = ServerInterceptor{
+	Unary: func(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+		recordHandlerContext(ctx)
+		return handler(ctx, req)
+	},
+	Stream: func(srv interface{}, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+		recordHandlerContext(ss.Context())
+		return handler(srv, ss)
+	},
+}
+
+// contextStream is a server stream with a modified context
+type contextStream struct {
+	grpc.ServerStream
+	ctx context.Context
+}
+
+func (c *contextStream) Context() context.Context {
+	return c.ctx
+}
+
+// RecoveryInterceptor returns interceptors that recover from panics in the
+// handlers. The panic is logged and the client gets an Internal error. Panics
+// are only caught in the interceptors that run after it. Set the
+// RecoverPanics server parameter to run it before every other interceptor,
+// including the metrics interceptors.
+func RecoveryInterceptor() ServerInterceptor {
+	recoverPanic := func(method string, err *error) {
+		if r := recover(); r != nil {
+			log.Printf("Panic in gRPC handler for %s: %v\n%s", method, r, debug.Stack())
+			*err = status.Error(codes.Internal, "internal error")
+		}
+	}
+	return ServerInterceptor{
+		Unary: func(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (resp interface{}, err error) {
+			defer recoverPanic(info.FullMethod, &err)
+			return handler(ctx, req)
+		},
+		Stream: func(srv interface{}, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) (err error) {
+			defer recoverPanic(info.FullMethod, &err)
+			return handler(srv, ss)
+		},
+	}
+}
+
+// RequestIDHeader is the metadata key for request IDs
+const RequestIDHeader = "x-request-id"
+
+type requestIDKey struct{}
+
+// RequestID returns the request ID set by the request ID interceptor. An empty
+// string is returned if there's no request ID in the context.
+func RequestID(ctx context.Context) string {
+	id, _ := ctx.Value(requestIDKey{}).(string)
+	return id
+}
+
+// requestIDContext returns a context with the request ID from the client or
+// a new random request ID. The ID is returned to the client in the header.
+func requestIDContext(ctx context.Context) context.Context {
+	var id string
+	if md, ok := metadata.FromIncomingContext(ctx); ok {
+		if ids := md.Get(RequestIDHeader); len(ids) > 0 {
+			id = ids[0]
+		}
+	}
+	if id == "" {
+		buf := make([]byte, 16)
+		if _, err := rand.Read(buf); err != nil {
+			log.Printf("Unable to generate request ID: %v", err)
+		}
+		id = hex.EncodeToString(buf)
+	}
+	if err := grpc.SetHeader(ctx, metadata.Pairs(RequestIDHeader, id)); err != nil {
+		log.Printf("Unable to set request ID header: %v", err)
+	}
+	return context.WithValue(ctx, requestIDKey{}, id)
+}
+
+// RequestIDInterceptor returns interceptors that assign a request ID to each
+// call. The ID is taken from the x-request-id metadata if the client sets it,
+// otherwise a random ID is generated. Use RequestID to read the ID in the
+// handlers.
+func RequestIDInterceptor() ServerInterceptor {
+	return ServerInterceptor{
+		Unary: func(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+			return handler(requestIDContext(ctx), req)
+		},
+		Stream: func(srv interface{}, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+			return handler(srv, &contextStream{ServerStream: ss, ctx: requestIDContext(ss.Context())})
+		},
+	}
+}
+
+// peerAddress returns the address of the peer or an empty string
+func peerAddress(ctx context.Context) string {
+	p, ok := peer.FromContext(ctx)
+	if !ok || p.Addr == nil {
+		return ""
+	}
+	return p.Addr.String()
+}
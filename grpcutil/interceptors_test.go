@@ -0,0 +1,127 @@
+package grpcutil
+
+//
+//Copyright 2019 Telenor Digital AS
+//
+//Licensed under the Apache License, Version 2.0 (the "License");
+//you may not use this file except in compliance with the License.
+//You may obtain a copy of the License at
+//
+//http://www.apache.org/licenses/LICENSE-2.0
+//
+//Unless required by applicable law or agreed to in writing, software
+//distributed under the License is distributed on an "AS IS" BASIS,
+//WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//See the License for the specific language governing permissions and
+//limitations under the License.
+//
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/health/grpc_health_v1"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+// recordingInterceptor records the name when called and panics if the
+// "panic" metadata is set
+func recordingInterceptor(name string, mutex *sync.Mutex, calls *[]string) ServerInterceptor {
+	return ServerInterceptor{
+		Unary: func(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+			mutex.Lock()
+			*calls = append(*calls, name)
+			mutex.Unlock()
+			if md, ok := metadata.FromIncomingContext(ctx); ok && len(md.Get("panic")) > 0 {
+				panic("boom")
+			}
+			return handler(ctx, req)
+		},
+	}
+}
+
+func TestInterceptorChain(t *testing.T) {
+	assert := require.New(t)
+
+	config := GRPCServerParam{Endpoint: "127.0.0.1:0", Health: true, Metrics: true}
+	server, err := NewGRPCServer(config)
+	assert.NoError(err)
+
+	mutex := &sync.Mutex{}
+	var calls []string
+	server.AddInterceptors(RecoveryInterceptor(), RequestIDInterceptor(), AccessLogInterceptor(nil))
+	server.AddInterceptors(recordingInterceptor("added", mutex, &calls))
+
+	var requestID string
+	opts, err := server.ServerOpts()
+	assert.NoError(err)
+	opts = append(opts, grpc.ChainUnaryInterceptor(func(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+		mutex.Lock()
+		calls = append(calls, "option")
+		mutex.Unlock()
+		return handler(ctx, req)
+	}))
+	server.AddInterceptors(ServerInterceptor{
+		Unary: func(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+			requestID = RequestID(ctx)
+			return handler(ctx, req)
+		},
+	})
+	assert.NoError(server.LaunchWithOpts(func(s *grpc.Server) {}, 100*time.Millisecond, opts))
+	defer server.Stop()
+
+	conn, err := NewGRPCClientConnection(GRPCClientParam{ServerEndpoint: server.ListenAddress().String()})
+	assert.NoError(err)
+	defer conn.Close()
+	client := grpc_health_v1.NewHealthClient(conn)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	var header metadata.MD
+	_, err = client.Check(metadata.AppendToOutgoingContext(ctx, RequestIDHeader, "request-1"), &grpc_health_v1.HealthCheckRequest{}, grpc.Header(&header))
+	assert.NoError(err)
+	assert.Equal([]string{"option", "added"}, calls)
+	assert.Equal("request-1", requestID)
+	assert.Equal([]string{"request-1"}, header.Get(RequestIDHeader))
+
+	// Generated request IDs
+	_, err = client.Check(ctx, &grpc_health_v1.HealthCheckRequest{}, grpc.Header(&header))
+	assert.NoError(err)
+	assert.Len(header.Get(RequestIDHeader)[0], 32)
+
+	// Panics are turned into errors
+	_, err = client.Check(metadata.AppendToOutgoingContext(ctx, "panic", "yes"), &grpc_health_v1.HealthCheckRequest{})
+	assert.Equal(codes.Internal, status.Code(err))
+
+	// Streams pass through the chain
+	stream, err := client.Watch(ctx, &grpc_health_v1.HealthCheckRequest{})
+	assert.NoError(err)
+	res, err := stream.Recv()
+	assert.NoError(err)
+	assert.Equal(grpc_health_v1.HealthCheckResponse_SERVING, res.Status)
+}
+
+func TestRecoverPanics(t *testing.T) {
+	assert := require.New(t)
+
+	mutex := &sync.Mutex{}
+	var calls []string
+	serverOpts := chainInterceptors([]ServerInterceptor{recordingInterceptor("option", mutex, &calls)})
+	_, conn := NewTestServer(t, GRPCServerParam{Health: true, Metrics: true, RecoverPanics: true}, GRPCClientParam{}, func(s *grpc.Server) {}, serverOpts)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	// Panics in option interceptors are caught too
+	client := grpc_health_v1.NewHealthClient(conn)
+	_, err := client.Check(metadata.AppendToOutgoingContext(ctx, "panic", "yes"), &grpc_health_v1.HealthCheckRequest{})
+	assert.Equal(codes.Internal, status.Code(err))
+	_, err = client.Check(ctx, &grpc_health_v1.HealthCheckRequest{})
+	assert.NoError(err)
+}
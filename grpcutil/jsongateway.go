@@ -0,0 +1,311 @@
+package grpcutil
+
+//
+//Copyright 2019 Telenor Digital AS
+//
+//Licensed under the Apache License, Version 2.0 (the "License");
+//you may not use this file except in compliance with the License.
+//You may obtain a copy of the License at
+//
+//http://www.apache.org/licenses/LICENSE-2.0
+//
+//Unless required by applicable law or agreed to in writing, software
+//distributed under the License is distributed on an "AS IS" BASIS,
+//WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//See the License for the specific language governing permissions and
+//limitations under the License.
+//
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"log"
+	"math"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+
+	spb "google.golang.org/genproto/googleapis/rpc/status"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/encoding/protojson"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/reflect/protoreflect"
+	"google.golang.org/protobuf/reflect/protoregistry"
+	"google.golang.org/protobuf/types/dynamicpb"
+)
+
+// maxJSONRequestSize is the maximum size of JSON requests. This is the same
+// as the default maximum message size for gRPC servers.
+const maxJSONRequestSize = 4 * 1024 * 1024
+
+// HTTPStatusFromCode maps gRPC status codes to HTTP status codes. The
+// mapping is the same as the one used by grpc-gateway.
+func HTTPStatusFromCode(code codes.Code) int {
+	switch code {
+	case codes.OK:
+		return http.StatusOK
+	case codes.Canceled:
+		return 499
+	case codes.InvalidArgument, codes.FailedPrecondition, codes.OutOfRange:
+		return http.StatusBadRequest
+	case codes.DeadlineExceeded:
+		return http.StatusGatewayTimeout
+	case codes.NotFound:
+		return http.StatusNotFound
+	case codes.AlreadyExists, codes.Aborted:
+		return http.StatusConflict
+	case codes.PermissionDenied:
+		return http.StatusForbidden
+	case codes.Unauthenticated:
+		return http.StatusUnauthorized
+	case codes.ResourceExhausted:
+		return http.StatusTooManyRequests
+	case codes.Unimplemented:
+		return http.StatusNotImplemented
+	case codes.Unavailable:
+		return http.StatusServiceUnavailable
+	default:
+		return http.StatusInternalServerError
+	}
+}
+
+// jsonGateway serves unary gRPC methods as JSON over HTTP. The request is
+// converted to a gRPC request and served by the gRPC server's ServeHTTP
+// method so interceptors, metadata and peer information work just like for
+// gRPC clients.
+type jsonGateway struct {
+	server   *grpc.Server
+	fallback http.Handler
+}
+
+// NewJSONGateway returns a handler that serves the unary methods registered
+// with the gRPC server as POST /package.Service/Method with JSON request and
+// response bodies. The messages are marshalled with protojson and the message
+// types are looked up through the registered service descriptors so no code
+// generation is required. HTTP headers are passed on as metadata, ie
+// the Authorization header for bearer tokens. Errors are returned with the
+// HTTP status for the gRPC status code and the google.rpc.Status as JSON.
+// Other requests are passed on to the fallback handler. Requests that don't
+// match a method get a 404 response if the fallback handler is nil.
+func NewJSONGateway(server *grpc.Server, fallback http.Handler) http.Handler {
+	if fallback == nil {
+		fallback = http.NotFoundHandler()
+	}
+	return &jsonGateway{server: server, fallback: fallback}
+}
+
+// unaryMethod returns the descriptor for a registered unary method. The path
+// is the full method name, ie /package.Service/Method
+func (j *jsonGateway) unaryMethod(path string) (protoreflect.MethodDescriptor, bool) {
+	serviceName, methodName := splitMethodName(path)
+	info, ok := j.server.GetServiceInfo()[serviceName]
+	if !ok {
+		return nil, false
+	}
+	found := false
+	for _, m := range info.Methods {
+		if m.Name == methodName && !m.IsClientStream && !m.IsServerStream {
+			found = true
+			break
+		}
+	}
+	if !found {
+		return nil, false
+	}
+	desc, err := protoregistry.GlobalFiles.FindDescriptorByName(protoreflect.FullName(serviceName))
+	if err != nil {
+		return nil, false
+	}
+	serviceDesc, ok := desc.(protoreflect.ServiceDescriptor)
+	if !ok {
+		return nil, false
+	}
+	method := serviceDesc.Methods().ByName(protoreflect.Name(methodName))
+	return method, method != nil
+}
+
+// newMessage returns a new message of the type. Dynamic messages are used
+// for types that aren't registered.
+func newMessage(desc protoreflect.MessageDescriptor) proto.Message {
+	if mt, err := protoregistry.GlobalTypes.FindMessageByName(desc.FullName()); err == nil {
+		return mt.New().Interface()
+	}
+	return dynamicpb.NewMessage(desc)
+}
+
+// writeJSONError writes the status as JSON with the matching HTTP status
+func writeJSONError(w http.ResponseWriter, s *status.Status) {
+	if delay, ok := RetryDelay(s.Err()); ok {
+		w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(delay.Seconds()))))
+	}
+	buf, err := protojson.Marshal(s.Proto())
+	if err != nil {
+		log.Printf("Unable to marshal status: %v", err)
+		buf = []byte(fmt.Sprintf(`{"code":%d}`, s.Code()))
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(HTTPStatusFromCode(s.Code()))
+	w.Write(buf)
+}
+
+// grpcResponse records the response from the gRPC server
+type grpcResponse struct {
+	header http.Header
+	body   bytes.Buffer
+}
+
+func (g *grpcResponse) Header() http.Header {
+	return g.header
+}
+
+func (g *grpcResponse) Write(buf []byte) (int, error) {
+	return g.body.Write(buf)
+}
+
+func (g *grpcResponse) WriteHeader(int) {
+}
+
+func (g *grpcResponse) Flush() {
+}
+
+// status returns the status from the gRPC trailers
+func (g *grpcResponse) status() *status.Status {
+	if details := g.header.Get("Grpc-Status-Details-Bin"); details != "" {
+		buf, err := base64.RawStdEncoding.DecodeString(strings.TrimRight(details, "="))
+		if err == nil {
+			s := &spb.Status{}
+			if err := proto.Unmarshal(buf, s); err == nil {
+				return status.FromProto(s)
+			}
+		}
+	}
+	code, err := strconv.Atoi(g.header.Get("Grpc-Status"))
+	if err != nil {
+		return status.New(codes.Internal, "missing status from gRPC server")
+	}
+	// The message is percent-encoded
+	msg := g.header.Get("Grpc-Message")
+	if decoded, err := url.PathUnescape(msg); err == nil {
+		msg = decoded
+	}
+	return status.New(codes.Code(code), msg)
+}
+
+// message returns the single response message
+func (g *grpcResponse) message() ([]byte, error) {
+	buf := g.body.Bytes()
+	if len(buf) < 5 {
+		return nil, fmt.Errorf("short response from gRPC server")
+	}
+	if buf[0] != 0 {
+		return nil, fmt.Errorf("compressed responses are not supported")
+	}
+	length := binary.BigEndian.Uint32(buf[1:5])
+	if uint32(len(buf)-5) < length {
+		return nil, fmt.Errorf("truncated response from gRPC server")
+	}
+	return buf[5 : 5+length], nil
+}
+
+func (j *jsonGateway) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	method, ok := j.unaryMethod(r.URL.Path)
+	if !ok {
+		j.fallback.ServeHTTP(w, r)
+		return
+	}
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	body, err := io.ReadAll(io.LimitReader(r.Body, maxJSONRequestSize+1))
+	if err != nil {
+		writeJSONError(w, status.New(codes.Internal, err.Error()))
+		return
+	}
+	if len(body) > maxJSONRequestSize {
+		writeJSONError(w, status.New(codes.ResourceExhausted, "request is too large"))
+		return
+	}
+	req := newMessage(method.Input())
+	if len(bytes.TrimSpace(body)) > 0 {
+		if err := protojson.Unmarshal(body, req); err != nil {
+			writeJSONError(w, status.Newf(codes.InvalidArgument, "invalid request: %v", err))
+			return
+		}
+	}
+	msg, err := proto.Marshal(req)
+	if err != nil {
+		writeJSONError(w, status.New(codes.Internal, err.Error()))
+		return
+	}
+	frame := make([]byte, 5, 5+len(msg))
+	binary.BigEndian.PutUint32(frame[1:], uint32(len(msg)))
+	frame = append(frame, msg...)
+
+	grpcReq := r.Clone(r.Context())
+	grpcReq.ProtoMajor, grpcReq.ProtoMinor, grpcReq.Proto = 2, 0, "HTTP/2.0"
+	grpcReq.Body = io.NopCloser(bytes.NewReader(frame))
+	grpcReq.ContentLength = int64(len(frame))
+	for name := range grpcReq.Header {
+		if strings.HasPrefix(strings.ToLower(name), "grpc-") && !strings.EqualFold(name, "grpc-timeout") {
+			grpcReq.Header.Del(name)
+		}
+	}
+	grpcReq.Header.Del("Content-Length")
+	grpcReq.Header.Set("Content-Type", "application/grpc+proto")
+	grpcReq.Header.Set("Te", "trailers")
+
+	res := &grpcResponse{header: make(http.Header)}
+	j.server.ServeHTTP(res, grpcReq)
+
+	// Response metadata is returned as headers
+	for name, values := range res.header {
+		lower := strings.ToLower(name)
+		if strings.HasPrefix(lower, "grpc-") || lower == "content-type" || lower == "trailer" || lower == "date" {
+			continue
+		}
+		for _, v := range values {
+			w.Header().Add(name, v)
+		}
+	}
+
+	s := res.status()
+	if s.Code() != codes.OK {
+		writeJSONError(w, s)
+		return
+	}
+	buf, err := res.message()
+	if err != nil {
+		writeJSONError(w, status.New(codes.Internal, err.Error()))
+		return
+	}
+	resp := newMessage(method.Output())
+	if err := proto.Unmarshal(buf, resp); err != nil {
+		writeJSONError(w, status.New(codes.Internal, err.Error()))
+		return
+	}
+	out, err := protojson.Marshal(resp)
+	if err != nil {
+		writeJSONError(w, status.New(codes.Internal, err.Error()))
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	w.Write(out)
+}
+
+// splitMethodName splits the full method name into service and method names
+func splitMethodName(fullMethod string) (string, string) {
+	fullMethod = strings.TrimPrefix(fullMethod, "/")
+	if i := strings.Index(fullMethod, "/"); i >= 0 {
+		return fullMethod[:i], fullMethod[i+1:]
+	}
+	return "unknown", "unknown"
+}
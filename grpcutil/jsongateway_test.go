@@ -0,0 +1,138 @@
+package grpcutil
+
+//
+//Copyright 2019 Telenor Digital AS
+//
+//Licensed under the Apache License, Version 2.0 (the "License");
+//you may not use this file except in compliance with the License.
+//You may obtain a copy of the License at
+//
+//http://www.apache.org/licenses/LICENSE-2.0
+//
+//Unless required by applicable law or agreed to in writing, software
+//distributed under the License is distributed on an "AS IS" BASIS,
+//WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//See the License for the specific language governing permissions and
+//limitations under the License.
+//
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/health/grpc_health_v1"
+)
+
+// postJSON posts the body and returns the status code, the response headers
+// and the decoded response
+func postJSON(t *testing.T, url, body string, header http.Header) (int, http.Header, map[string]interface{}) {
+	req, err := http.NewRequest(http.MethodPost, url, strings.NewReader(body))
+	require.NoError(t, err)
+	for name, values := range header {
+		req.Header[name] = values
+	}
+	req.Header.Set("Content-Type", "application/json")
+	res, err := http.DefaultClient.Do(req)
+	require.NoError(t, err)
+	defer res.Body.Close()
+	buf, err := io.ReadAll(res.Body)
+	require.NoError(t, err)
+	ret := make(map[string]interface{})
+	if res.Header.Get("Content-Type") == "application/json" {
+		require.NoError(t, json.Unmarshal(buf, &ret), string(buf))
+	}
+	return res.StatusCode, res.Header, ret
+}
+
+func TestJSONGateway(t *testing.T) {
+	assert := require.New(t)
+
+	verifier := NewMemoryTokenVerifier(map[string]Principal{"token-1": {Subject: "alice"}})
+	server, err := NewGRPCServer(GRPCServerParam{Endpoint: "127.0.0.1:0", Health: true, JSONGateway: true})
+	assert.NoError(err)
+	server.AddInterceptors(RequestIDInterceptor(), BearerTokenInterceptor(verifier))
+	server.SetHTTPHandler(newTestRouter())
+	assert.NoError(server.Launch(func(s *grpc.Server) {}, time.Second))
+	defer server.Stop()
+	baseURL := "http://" + server.ListenAddress().String()
+	auth := http.Header{"Authorization": []string{"Bearer token-1"}}
+
+	code, header, res := postJSON(t, baseURL+"/grpc.health.v1.Health/Check", `{"service": ""}`, auth)
+	assert.Equal(http.StatusOK, code)
+	assert.Equal("SERVING", res["status"])
+	assert.NotEmpty(header.Get(RequestIDHeader))
+
+	// Empty bodies are empty messages
+	code, _, res = postJSON(t, baseURL+"/grpc.health.v1.Health/Check", "", auth)
+	assert.Equal(http.StatusOK, code)
+	assert.Equal("SERVING", res["status"])
+
+	// gRPC errors are mapped to HTTP status codes
+	code, _, res = postJSON(t, baseURL+"/grpc.health.v1.Health/Check", `{"service": "unknown"}`, auth)
+	assert.Equal(http.StatusNotFound, code)
+	assert.Equal(float64(codes.NotFound), res["code"])
+	assert.Contains(res["message"], "unknown service")
+
+	code, _, _ = postJSON(t, baseURL+"/grpc.health.v1.Health/Check", `{}`, nil)
+	assert.Equal(http.StatusUnauthorized, code)
+
+	code, _, res = postJSON(t, baseURL+"/grpc.health.v1.Health/Check", `{"unknownField": 1}`, auth)
+	assert.Equal(http.StatusBadRequest, code)
+	assert.Equal(float64(codes.InvalidArgument), res["code"])
+
+	// Streaming methods aren't served and other requests go to the HTTP handler
+	code, _, _ = postJSON(t, baseURL+"/grpc.health.v1.Health/Watch", `{}`, auth)
+	assert.Equal(http.StatusNotFound, code)
+	resp, err := http.Get(baseURL + "/grpc.health.v1.Health/Check")
+	assert.NoError(err)
+	resp.Body.Close()
+	assert.Equal(http.StatusMethodNotAllowed, resp.StatusCode)
+	resp, err = http.Get(baseURL + "/hello/world")
+	assert.NoError(err)
+	resp.Body.Close()
+	assert.Equal(http.StatusOK, resp.StatusCode)
+
+	// gRPC clients still work
+	conn, err := NewGRPCClientConnection(GRPCClientParam{ServerEndpoint: server.ListenAddress().String(), Token: "token-1"})
+	assert.NoError(err)
+	defer conn.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	_, err = grpc_health_v1.NewHealthClient(conn).Check(ctx, &grpc_health_v1.HealthCheckRequest{})
+	assert.NoError(err)
+}
+
+func TestJSONGatewayRetryAfter(t *testing.T) {
+	assert := require.New(t)
+
+	server, err := NewGRPCServer(GRPCServerParam{Endpoint: "127.0.0.1:0", Health: true, JSONGateway: true})
+	assert.NoError(err)
+	server.AddInterceptors(ServerInterceptor{
+		Unary: func(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+			return nil, limitExceeded("rate", "test", 1500*time.Millisecond)
+		},
+	})
+	assert.NoError(server.Launch(func(s *grpc.Server) {}, time.Second))
+	defer server.Stop()
+
+	code, header, res := postJSON(t, "http://"+server.ListenAddress().String()+"/grpc.health.v1.Health/Check", `{}`, nil)
+	assert.Equal(http.StatusTooManyRequests, code)
+	assert.Equal("2", header.Get("Retry-After"))
+	assert.Equal(float64(codes.ResourceExhausted), res["code"])
+	assert.Len(res["details"], 1)
+
+	// Services that aren't in the descriptor registry aren't served
+	server, err = NewGRPCServer(GRPCServerParam{Endpoint: "127.0.0.1:0", JSONGateway: true})
+	assert.NoError(err)
+	assert.NoError(server.Launch(registerEcho, time.Second))
+	defer server.Stop()
+	code, _, _ = postJSON(t, "http://"+server.ListenAddress().String()+"/test.Echo/Echo", `{}`, nil)
+	assert.Equal(http.StatusNotFound, code)
+}
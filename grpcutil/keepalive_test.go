@@ -0,0 +1,51 @@
+package grpcutil
+
+//
+//Copyright 2019 Telenor Digital AS
+//
+//Licensed under the Apache License, Version 2.0 (the "License");
+//you may not use this file except in compliance with the License.
+//You may obtain a copy of the License at
+//
+//http://www.apache.org/licenses/LICENSE-2.0
+//
+//Unless required by applicable law or agreed to in writing, software
+//distributed under the License is distributed on an "AS IS" BASIS,
+//WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//See the License for the specific language governing permissions and
+//limitations under the License.
+//
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/connectivity"
+	"google.golang.org/grpc/health/grpc_health_v1"
+)
+
+func TestMaxConnectionIdle(t *testing.T) {
+	assert := require.New(t)
+
+	_, conn := NewTestServer(t,
+		GRPCServerParam{Health: true, MaxConnectionIdle: 50 * time.Millisecond},
+		GRPCClientParam{KeepaliveTime: 10 * time.Second, KeepaliveTimeout: time.Second},
+		func(s *grpc.Server) {}, nil)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	_, err := grpc_health_v1.NewHealthClient(conn).Check(ctx, &grpc_health_v1.HealthCheckRequest{})
+	assert.NoError(err)
+	assert.Equal(connectivity.Ready, conn.GetState())
+
+	// The server closes the idle connection
+	assert.Eventually(func() bool {
+		return conn.GetState() == connectivity.Idle
+	}, 2*time.Second, 10*time.Millisecond)
+
+	// ...and the client reconnects on the next call
+	_, err = grpc_health_v1.NewHealthClient(conn).Check(ctx, &grpc_health_v1.HealthCheckRequest{})
+	assert.NoError(err)
+}
@@ -0,0 +1,65 @@
+package grpcutil
+
+//
+//Copyright 2019 Telenor Digital AS
+//
+//Licensed under the Apache License, Version 2.0 (the "License");
+//you may not use this file except in compliance with the License.
+//You may obtain a copy of the License at
+//
+//http://www.apache.org/licenses/LICENSE-2.0
+//
+//Unless required by applicable law or agreed to in writing, software
+//distributed under the License is distributed on an "AS IS" BASIS,
+//WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//See the License for the specific language governing permissions and
+//limitations under the License.
+//
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc"
+)
+
+func TestLaunchAndWait(t *testing.T) {
+	assert := require.New(t)
+
+	server, err := NewGRPCServer(GRPCServerParam{Endpoint: "127.0.0.1:0"})
+	assert.NoError(err)
+	assert.NoError(server.Launch(func(s *grpc.Server) {}, time.Second))
+
+	select {
+	case <-server.Done():
+		t.Fatal("Server should be running")
+	default:
+	}
+	assert.NoError(server.Err())
+
+	server.Stop()
+	assert.NoError(server.Wait())
+}
+
+func TestTerminalError(t *testing.T) {
+	assert := require.New(t)
+
+	server, err := NewGRPCServer(GRPCServerParam{Endpoint: "127.0.0.1:0"})
+	assert.NoError(err)
+	assert.NoError(server.Launch(func(s *grpc.Server) {}, time.Second))
+
+	// Closing the listener makes Serve fail after the server has launched
+	server.(*grpcServer).listener.Close()
+	assert.Error(server.Wait())
+	assert.Error(server.Err())
+}
+
+func TestLaunchFailure(t *testing.T) {
+	assert := require.New(t)
+
+	server, err := NewGRPCServer(GRPCServerParam{Endpoint: "127.0.0.1:0", TLS: true})
+	assert.NoError(err)
+	assert.Error(server.Launch(func(s *grpc.Server) {}, time.Second))
+	<-server.Done()
+	assert.Error(server.Err())
+}
@@ -0,0 +1,242 @@
+package grpcutil
+
+//
+//Copyright 2019 Telenor Digital AS
+//
+//Licensed under the Apache License, Version 2.0 (the "License");
+//you may not use this file except in compliance with the License.
+//You may obtain a copy of the License at
+//
+//http://www.apache.org/licenses/LICENSE-2.0
+//
+//Unless required by applicable law or agreed to in writing, software
+//distributed under the License is distributed on an "AS IS" BASIS,
+//WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//See the License for the specific language governing permissions and
+//limitations under the License.
+//
+import (
+	"context"
+	"fmt"
+	"math"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/durationpb"
+)
+
+// LimitConfig is the configuration for the limit interceptor. Limits are
+// disabled when they are set to zero.
+type LimitConfig struct {
+	MaxConcurrentCalls int     // Maximum number of in-flight calls
+	Rate               float64 // Calls per second
+	Burst              int     // Calls allowed in a burst, defaults to the rate rounded up
+	PerPeer            bool    // Apply limits per peer identity rather than per method
+}
+
+// limitConfig returns the limit configuration from the server parameters
+func limitConfig(config GRPCServerParam) LimitConfig {
+	return LimitConfig{
+		MaxConcurrentCalls: config.MaxConcurrentCalls,
+		Rate:               config.RateLimit,
+		Burst:              config.RateBurst,
+		PerPeer:            config.LimitPerPeer,
+	}
+}
+
+func (l LimitConfig) enabled() bool {
+	return l.MaxConcurrentCalls > 0 || l.Rate > 0
+}
+
+// limitOpts returns the server options for the limit interceptor if limits
+// are set in the server parameters. The server adds these after the
+// interceptors added with AddInterceptors so per-peer limits apply to the
+// authenticated principal.
+func limitOpts(config GRPCServerParam) []grpc.ServerOption {
+	limits := limitConfig(config)
+	if !limits.enabled() {
+		return nil
+	}
+	return chainInterceptors([]ServerInterceptor{LimitInterceptor(limits)})
+}
+
+// concurrencyRetryDelay is the retry hint for calls rejected by the
+// concurrency limit. There's no way of knowing when a call completes so this
+// is just a short delay.
+const concurrencyRetryDelay = 100 * time.Millisecond
+
+// limiterSweepInterval is how often idle limiter entries are removed
+const limiterSweepInterval = time.Minute
+
+// limitEntry holds the in-flight count and the token bucket for a single key
+type limitEntry struct {
+	inFlight int
+	tokens   float64
+	last     time.Time
+}
+
+type limiter struct {
+	config    LimitConfig
+	burst     float64
+	mutex     *sync.Mutex
+	entries   map[string]*limitEntry
+	lastSweep time.Time
+}
+
+func newLimiter(config LimitConfig) *limiter {
+	burst := float64(config.Burst)
+	if burst <= 0 {
+		burst = math.Max(1, math.Ceil(config.Rate))
+	}
+	return &limiter{
+		config:    config,
+		burst:     burst,
+		mutex:     &sync.Mutex{},
+		entries:   make(map[string]*limitEntry),
+		lastSweep: time.Now(),
+	}
+}
+
+// refill adds tokens to the bucket for the time since the last refill
+func (l *limiter) refill(entry *limitEntry, now time.Time) {
+	entry.tokens = math.Min(l.burst, entry.tokens+now.Sub(entry.last).Seconds()*l.config.Rate)
+	entry.last = now
+}
+
+// sweep removes entries with no calls in flight and a full token bucket.
+// The mutex must be held when this is called.
+func (l *limiter) sweep(now time.Time) {
+	if now.Sub(l.lastSweep) < limiterSweepInterval {
+		return
+	}
+	l.lastSweep = now
+	for key, entry := range l.entries {
+		l.refill(entry, now)
+		if entry.inFlight == 0 && entry.tokens >= l.burst {
+			delete(l.entries, key)
+		}
+	}
+}
+
+// acquire reserves a call for the key. The returned function must be called
+// when the call completes. If the call is rejected the name of the limit and
+// the retry hint is returned.
+func (l *limiter) acquire(key string) (func(), string, time.Duration) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	now := time.Now()
+	l.sweep(now)
+	entry, ok := l.entries[key]
+	if !ok {
+		entry = &limitEntry{tokens: l.burst, last: now}
+		l.entries[key] = entry
+	}
+
+	if l.config.MaxConcurrentCalls > 0 && entry.inFlight >= l.config.MaxConcurrentCalls {
+		return nil, "concurrency", concurrencyRetryDelay
+	}
+	if l.config.Rate > 0 {
+		l.refill(entry, now)
+		if entry.tokens < 1 {
+			return nil, "rate", time.Duration((1 - entry.tokens) / l.config.Rate * float64(time.Second))
+		}
+		entry.tokens--
+	}
+	entry.inFlight++
+	return func() {
+		l.mutex.Lock()
+		defer l.mutex.Unlock()
+		entry.inFlight--
+	}, "", 0
+}
+
+// peerIdentity returns the identity of the peer for per-peer limits. This is
+// the principal's subject if the call is authenticated, the common name of
+// the client certificate or the peer's IP address, in that order.
+func peerIdentity(ctx context.Context) string {
+	if principal, ok := PrincipalFromContext(ctx); ok && principal.Subject != "" {
+		return "principal:" + principal.Subject
+	}
+	if cert, ok := PeerCertificate(ctx); ok {
+		return "cert:" + cert.Subject.CommonName
+	}
+	addr := peerAddress(ctx)
+	if host, _, err := net.SplitHostPort(addr); err == nil {
+		return "addr:" + host
+	}
+	return "addr:" + addr
+}
+
+// limitExceeded returns a ResourceExhausted error with a retry hint
+func limitExceeded(limit, key string, delay time.Duration) error {
+	s := status.New(codes.ResourceExhausted, fmt.Sprintf("%s limit exceeded for %s", limit, key))
+	withDetails, err := s.WithDetails(&errdetails.RetryInfo{RetryDelay: durationpb.New(delay)})
+	if err != nil {
+		return s.Err()
+	}
+	return withDetails.Err()
+}
+
+// LimitInterceptor returns interceptors that limit the number of in-flight
+// calls and the call rate per method or per peer. Calls that exceed a limit
+// fail with ResourceExhausted and a RetryInfo detail with the suggested
+// delay before retrying. Rejected calls are counted in the
+// grpcutil_server_rejected_total metric. Calls to the health service are never
+// limited. Servers with limits in the parameters add this after the
+// interceptors added with AddInterceptors. When using it directly add it
+// after the authentication interceptor to apply per-peer limits to the
+// authenticated principal.
+func LimitInterceptor(config LimitConfig) ServerInterceptor {
+	l := newLimiter(config)
+	acquire := func(ctx context.Context, method string) (func(), error) {
+		if strings.HasPrefix(method, "/grpc.health.v1.Health/") {
+			return func() {}, nil
+		}
+		key := method
+		if config.PerPeer {
+			key = peerIdentity(ctx)
+		}
+		release, limit, delay := l.acquire(key)
+		if release == nil {
+			rejectedCounter.WithLabelValues(method, limit).Inc()
+			return nil, limitExceeded(limit, key, delay)
+		}
+		return release, nil
+	}
+	return ServerInterceptor{
+		Unary: func(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+			release, err := acquire(ctx, info.FullMethod)
+			if err != nil {
+				return nil, err
+			}
+			defer release()
+			return handler(ctx, req)
+		},
+		Stream: func(srv interface{}, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+			release, err := acquire(ss.Context(), info.FullMethod)
+			if err != nil {
+				return err
+			}
+			defer release()
+			return handler(srv, ss)
+		},
+	}
+}
+
+// RetryDelay returns the retry hint in the error details. False is returned
+// if the error doesn't include a retry hint.
+func RetryDelay(err error) (time.Duration, bool) {
+	for _, detail := range status.Convert(err).Details() {
+		if info, ok := detail.(*errdetails.RetryInfo); ok && info.RetryDelay != nil {
+			return info.RetryDelay.AsDuration(), true
+		}
+	}
+	return 0, false
+}
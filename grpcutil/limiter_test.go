@@ -0,0 +1,198 @@
+package grpcutil
+
+//
+//Copyright 2019 Telenor Digital AS
+//
+//Licensed under the Apache License, Version 2.0 (the "License");
+//you may not use this file except in compliance with the License.
+//You may obtain a copy of the License at
+//
+//http://www.apache.org/licenses/LICENSE-2.0
+//
+//Unless required by applicable law or agreed to in writing, software
+//distributed under the License is distributed on an "AS IS" BASIS,
+//WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//See the License for the specific language governing permissions and
+//limitations under the License.
+//
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/health/grpc_health_v1"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
+)
+
+// echoServiceDesc is a service with a single unary method that returns the
+// health check request's service name as the status.
+var echoServiceDesc = grpc.ServiceDesc{
+	ServiceName: "test.Echo",
+	HandlerType: (*interface{})(nil),
+	Methods: []grpc.MethodDesc{{
+		MethodName: "Echo",
+		Handler: func(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+			req := &grpc_health_v1.HealthCheckRequest{}
+			if err := dec(req); err != nil {
+				return nil, err
+			}
+			handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+				return &grpc_health_v1.HealthCheckResponse{Status: grpc_health_v1.HealthCheckResponse_SERVING}, nil
+			}
+			if interceptor == nil {
+				return handler(ctx, req)
+			}
+			return interceptor(ctx, req, &grpc.UnaryServerInfo{Server: srv, FullMethod: "/test.Echo/Echo"}, handler)
+		},
+	}},
+}
+
+func registerEcho(s *grpc.Server) {
+	s.RegisterService(&echoServiceDesc, struct{}{})
+}
+
+func callEcho(ctx context.Context, conn *grpc.ClientConn) error {
+	return conn.Invoke(ctx, "/test.Echo/Echo", &grpc_health_v1.HealthCheckRequest{}, &grpc_health_v1.HealthCheckResponse{})
+}
+
+func TestRateLimit(t *testing.T) {
+	assert := require.New(t)
+
+	_, conn := NewTestServer(t,
+		GRPCServerParam{Health: true, Metrics: true, RateLimit: 10, RateBurst: 2},
+		GRPCClientParam{}, registerEcho, nil)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	rejected := sampleCount(t, "grpcutil_server_rejected_total", "/test.Echo/Echo")
+	assert.NoError(callEcho(ctx, conn))
+	assert.NoError(callEcho(ctx, conn))
+	err := callEcho(ctx, conn)
+	assert.Equal(codes.ResourceExhausted, status.Code(err))
+	delay, ok := RetryDelay(err)
+	assert.True(ok)
+	assert.True(delay > 0 && delay <= 100*time.Millisecond, delay)
+	assert.Equal(rejected+1, sampleCount(t, "grpcutil_server_rejected_total", "/test.Echo/Echo"))
+
+	// The health service isn't limited
+	for i := 0; i < 5; i++ {
+		_, err := grpc_health_v1.NewHealthClient(conn).Check(ctx, &grpc_health_v1.HealthCheckRequest{})
+		assert.NoError(err)
+	}
+
+	// The call succeeds after the retry delay
+	time.Sleep(delay)
+	assert.NoError(callEcho(ctx, conn))
+}
+
+func TestRetryHonorsRetryDelay(t *testing.T) {
+	assert := require.New(t)
+
+	_, conn := NewTestServer(t,
+		GRPCServerParam{RateLimit: 5, RateBurst: 1},
+		GRPCClientParam{RetryMaxAttempts: 2, RetryInitialBackoff: time.Millisecond, RetryCodes: []string{"RESOURCE_EXHAUSTED"}},
+		registerEcho, nil)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	assert.NoError(callEcho(ctx, conn))
+	start := time.Now()
+	assert.NoError(callEcho(ctx, conn))
+	assert.True(time.Since(start) >= 150*time.Millisecond)
+}
+
+// limitedCall calls the unary interceptor from a peer. The handler blocks
+// until the release channel is closed and the result channel gets the error
+// returned by the interceptor.
+func limitedCall(interceptor ServerInterceptor, addr string, method string) (chan struct{}, chan error) {
+	tcpAddr, _ := net.ResolveTCPAddr("tcp", addr)
+	ctx := peer.NewContext(context.Background(), &peer.Peer{Addr: tcpAddr})
+	release := make(chan struct{})
+	started := make(chan struct{})
+	result := make(chan error, 1)
+	go func() {
+		_, err := interceptor.Unary(ctx, nil, &grpc.UnaryServerInfo{FullMethod: method}, func(ctx context.Context, req interface{}) (interface{}, error) {
+			close(started)
+			<-release
+			return nil, nil
+		})
+		result <- err
+	}()
+	select {
+	case <-started:
+	case err := <-result:
+		result <- err
+	}
+	return release, result
+}
+
+func TestConcurrencyLimitPerPeer(t *testing.T) {
+	assert := require.New(t)
+
+	interceptor := LimitInterceptor(LimitConfig{MaxConcurrentCalls: 1, PerPeer: true})
+
+	releaseA, resultA := limitedCall(interceptor, "10.0.0.1:1000", "/test.Echo/A")
+	// Same peer, different port and method
+	_, resultB := limitedCall(interceptor, "10.0.0.1:2000", "/test.Echo/B")
+	err := <-resultB
+	assert.Equal(codes.ResourceExhausted, status.Code(err))
+	delay, ok := RetryDelay(err)
+	assert.True(ok)
+	assert.Equal(concurrencyRetryDelay, delay)
+
+	// Other peers aren't affected
+	releaseC, resultC := limitedCall(interceptor, "10.0.0.2:1000", "/test.Echo/A")
+	close(releaseC)
+	assert.NoError(<-resultC)
+
+	// The peer can make calls when the first call completes
+	close(releaseA)
+	assert.NoError(<-resultA)
+	releaseD, resultD := limitedCall(interceptor, "10.0.0.1:1000", "/test.Echo/A")
+	close(releaseD)
+	assert.NoError(<-resultD)
+
+	_, ok = RetryDelay(status.Error(codes.Unavailable, "unavailable"))
+	assert.False(ok)
+}
+
+func TestRateLimitPerPrincipal(t *testing.T) {
+	assert := require.New(t)
+
+	verifier := NewMemoryTokenVerifier(map[string]Principal{
+		"token-1": {Subject: "alice"},
+		"token-2": {Subject: "bob"},
+	})
+	server, err := NewGRPCServer(GRPCServerParam{Endpoint: "127.0.0.1:0", RateLimit: 0.1, RateBurst: 1, LimitPerPeer: true})
+	assert.NoError(err)
+	// The limiter runs after the added interceptors so the limits are per
+	// principal even though every call comes from the same address
+	server.AddInterceptors(BearerTokenInterceptor(verifier))
+	assert.NoError(server.Launch(registerEcho, time.Second))
+	defer server.Stop()
+
+	conn, err := NewGRPCClientConnection(GRPCClientParam{ServerEndpoint: server.ListenAddress().String()})
+	assert.NoError(err)
+	defer conn.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	call := func(token string) error {
+		return conn.Invoke(ctx, "/test.Echo/Echo", &grpc_health_v1.HealthCheckRequest{}, &grpc_health_v1.HealthCheckResponse{},
+			grpc.PerRPCCredentials(NewTokenCredentials(token, false)))
+	}
+
+	assert.NoError(call("token-1"))
+	assert.Equal(codes.ResourceExhausted, status.Code(call("token-1")))
+	assert.NoError(call("token-2"))
+	assert.Equal(codes.ResourceExhausted, status.Code(call("token-2")))
+
+	// Unauthenticated calls are rejected before they are counted
+	assert.Equal(codes.Unauthenticated, status.Code(call("unknown")))
+}
@@ -0,0 +1,155 @@
+package grpcutil
+
+//
+//Copyright 2019 Telenor Digital AS
+//
+//Licensed under the Apache License, Version 2.0 (the "License");
+//you may not use this file except in compliance with the License.
+//You may obtain a copy of the License at
+//
+//http://www.apache.org/licenses/LICENSE-2.0
+//
+//Unless required by applicable law or agreed to in writing, software
+//distributed under the License is distributed on an "AS IS" BASIS,
+//WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//See the License for the specific language governing permissions and
+//limitations under the License.
+//
+import (
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// readyListener signals readiness the first time Accept is called, ie when
+// the server has started serving.
+type readyListener struct {
+	net.Listener
+	once  *sync.Once
+	ready chan struct{}
+}
+
+func newReadyListener(listener net.Listener, ready chan struct{}) *readyListener {
+	return &readyListener{
+		Listener: listener,
+		once:     &sync.Once{},
+		ready:    ready,
+	}
+}
+
+func (r *readyListener) Accept() (net.Conn, error) {
+	r.once.Do(func() { close(r.ready) })
+	return r.Listener.Accept()
+}
+
+// Prefixes for Unix domain socket endpoints. These are the same as the gRPC
+// client uses for name resolution.
+const (
+	unixPrefix         = "unix:"
+	unixAbstractPrefix = "unix-abstract:"
+)
+
+// parseEndpoint returns the network and address for an endpoint. Endpoints
+// are either host:port for TCP, unix:path or unix:///absolute/path for Unix
+// domain sockets or unix-abstract:name for abstract Unix domain sockets.
+func parseEndpoint(endpoint string) (string, string, error) {
+	switch {
+	case strings.HasPrefix(endpoint, unixAbstractPrefix):
+		name := strings.TrimPrefix(endpoint, unixAbstractPrefix)
+		if name == "" {
+			return "", "", errors.New("missing name for abstract socket")
+		}
+		return "unix", "@" + name, nil
+	case strings.HasPrefix(endpoint, unixPrefix):
+		path := strings.TrimPrefix(endpoint, unixPrefix)
+		if strings.HasPrefix(path, "//") {
+			path = strings.TrimPrefix(path, "//")
+			if !strings.HasPrefix(path, "/") {
+				return "", "", fmt.Errorf("socket path must be absolute: %s", endpoint)
+			}
+		}
+		if path == "" {
+			return "", "", errors.New("missing path for Unix domain socket")
+		}
+		return "unix", path, nil
+	default:
+		return "tcp", endpoint, nil
+	}
+}
+
+// removeStaleSocket removes a socket file if nothing is listening on it. An
+// error is returned if the file isn't a socket or if the socket is in use.
+func removeStaleSocket(path string) error {
+	fi, err := os.Stat(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if fi.Mode()&os.ModeSocket == 0 {
+		return fmt.Errorf("%s exists and is not a socket", path)
+	}
+	conn, err := net.Dial("unix", path)
+	if err == nil {
+		conn.Close()
+		return fmt.Errorf("socket %s is in use", path)
+	}
+	return os.Remove(path)
+}
+
+// listen creates a listener for the endpoint. Stale socket files for Unix
+// domain sockets are removed and the file mode is set if it's specified as
+// an octal string, ie "0660".
+func listen(endpoint string, socketMode string) (net.Listener, error) {
+	network, address, err := parseEndpoint(endpoint)
+	if err != nil {
+		return nil, err
+	}
+	if network == "tcp" {
+		return net.Listen(network, address)
+	}
+	abstract := strings.HasPrefix(address, "@")
+	if !abstract {
+		if err := removeStaleSocket(address); err != nil {
+			return nil, err
+		}
+	}
+	listener, err := net.Listen(network, address)
+	if err != nil {
+		return nil, err
+	}
+	if socketMode != "" && !abstract {
+		mode, err := strconv.ParseUint(socketMode, 8, 32)
+		if err != nil {
+			listener.Close()
+			return nil, fmt.Errorf("invalid socket mode %s: %v", socketMode, err)
+		}
+		if err := os.Chmod(address, os.FileMode(mode)); err != nil {
+			listener.Close()
+			return nil, err
+		}
+	}
+	return listener, nil
+}
+
+// ClientEndpoint returns the endpoint a client uses to connect to the
+// address, ie host:port for TCP addresses and unix:///path or
+// unix-abstract:name for Unix domain sockets.
+func ClientEndpoint(addr net.Addr) string {
+	unixAddr, ok := addr.(*net.UnixAddr)
+	if !ok {
+		return addr.String()
+	}
+	if strings.HasPrefix(unixAddr.Name, "@") {
+		return unixAbstractPrefix + strings.TrimPrefix(unixAddr.Name, "@")
+	}
+	if strings.HasPrefix(unixAddr.Name, "/") {
+		return unixPrefix + "//" + unixAddr.Name
+	}
+	return unixPrefix + unixAddr.Name
+}
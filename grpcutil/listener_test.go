@@ -0,0 +1,124 @@
+package grpcutil
+
+//
+//Copyright 2019 Telenor Digital AS
+//
+//Licensed under the Apache License, Version 2.0 (the "License");
+//you may not use this file except in compliance with the License.
+//You may obtain a copy of the License at
+//
+//http://www.apache.org/licenses/LICENSE-2.0
+//
+//Unless required by applicable law or agreed to in writing, software
+//distributed under the License is distributed on an "AS IS" BASIS,
+//WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//See the License for the specific language governing permissions and
+//limitations under the License.
+//
+import (
+	"context"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"runtime"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/health/grpc_health_v1"
+)
+
+func TestParseEndpoint(t *testing.T) {
+	assert := require.New(t)
+
+	for endpoint, expected := range map[string][2]string{
+		"localhost:1234":            {"tcp", "localhost:1234"},
+		"unix:relative.sock":        {"unix", "relative.sock"},
+		"unix:/tmp/absolute.sock":   {"unix", "/tmp/absolute.sock"},
+		"unix:///tmp/absolute.sock": {"unix", "/tmp/absolute.sock"},
+		"unix-abstract:name":        {"unix", "@name"},
+	} {
+		network, address, err := parseEndpoint(endpoint)
+		assert.NoError(err, endpoint)
+		assert.Equal(expected[0], network, endpoint)
+		assert.Equal(expected[1], address, endpoint)
+	}
+
+	for _, endpoint := range []string{"unix:", "unix://relative.sock", "unix-abstract:"} {
+		_, _, err := parseEndpoint(endpoint)
+		assert.Error(err, endpoint)
+	}
+}
+
+// checkEndpoint launches a server on the endpoint and does a health check
+func checkEndpoint(t *testing.T, params GRPCServerParam) GRPCServer {
+	assert := require.New(t)
+
+	params.Health = true
+	server, err := NewGRPCServer(params)
+	assert.NoError(err)
+	assert.NoError(server.Launch(func(s *grpc.Server) {}, time.Second))
+	t.Cleanup(server.Stop)
+
+	conn, err := NewGRPCClientConnection(GRPCClientParam{ServerEndpoint: ClientEndpoint(server.ListenAddress())})
+	assert.NoError(err)
+	defer conn.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	_, err = grpc_health_v1.NewHealthClient(conn).Check(ctx, &grpc_health_v1.HealthCheckRequest{})
+	assert.NoError(err)
+	return server
+}
+
+func TestUnixSocketEndpoint(t *testing.T) {
+	assert := require.New(t)
+
+	socket := filepath.Join(t.TempDir(), "grpc.sock")
+	server := checkEndpoint(t, GRPCServerParam{Endpoint: "unix://" + socket, SocketMode: "0600"})
+	assert.Equal("unix://"+socket, ClientEndpoint(server.ListenAddress()))
+
+	fi, err := os.Stat(socket)
+	assert.NoError(err)
+	assert.Equal(os.FileMode(0600), fi.Mode().Perm())
+
+	// The socket is in use
+	_, err = NewGRPCServer(GRPCServerParam{Endpoint: "unix:" + socket})
+	assert.Error(err)
+
+	// The socket file is removed when the server stops
+	server.Stop()
+	assert.NoError(server.Wait())
+	_, err = os.Stat(socket)
+	assert.True(os.IsNotExist(err))
+}
+
+func TestStaleUnixSocket(t *testing.T) {
+	assert := require.New(t)
+
+	socket := filepath.Join(t.TempDir(), "stale.sock")
+	listener, err := net.ListenUnix("unix", &net.UnixAddr{Name: socket, Net: "unix"})
+	assert.NoError(err)
+	listener.SetUnlinkOnClose(false)
+	listener.Close()
+
+	checkEndpoint(t, GRPCServerParam{Endpoint: "unix:" + socket})
+
+	// Regular files are left alone
+	file := filepath.Join(t.TempDir(), "file")
+	assert.NoError(os.WriteFile(file, []byte("data"), 0600))
+	_, err = NewGRPCServer(GRPCServerParam{Endpoint: "unix:" + file})
+	assert.Error(err)
+
+	_, err = NewGRPCServer(GRPCServerParam{Endpoint: "unix:" + filepath.Join(t.TempDir(), "mode.sock"), SocketMode: "rw"})
+	assert.Error(err)
+}
+
+func TestAbstractUnixSocket(t *testing.T) {
+	if runtime.GOOS != "linux" {
+		t.Skip("Abstract sockets are only supported on Linux")
+	}
+	checkEndpoint(t, GRPCServerParam{Endpoint: fmt.Sprintf("unix-abstract:grpcutil-test-%d", os.Getpid())})
+}
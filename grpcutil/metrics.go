@@ -0,0 +1,64 @@
+package grpcutil
+
+//
+//Copyright 2019 Telenor Digital AS
+//
+//Licensed under the Apache License, Version 2.0 (the "License");
+//you may not use this file except in compliance with the License.
+//You may obtain a copy of the License at
+//
+//http://www.apache.org/licenses/LICENSE-2.0
+//
+//Unless required by applicable law or agreed to in writing, software
+//distributed under the License is distributed on an "AS IS" BASIS,
+//WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//See the License for the specific language governing permissions and
+//limitations under the License.
+//
+import (
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Metrics exported by the grpcutil package. These are registered with the
+// default Prometheus registry, just like the grpc_prometheus metrics.
+var (
+	certReloadCounter = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "grpcutil_certificate_reloads_total",
+		Help: "Number of TLS certificate reloads by result",
+	}, []string{"result"})
+
+	certExpiryGauge = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "grpcutil_certificate_expiry_timestamp_seconds",
+		Help: "Expiry time of the currently served TLS certificate by certificate file",
+	}, []string{"cert_file"})
+
+	retryCounter = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "grpcutil_client_retries_total",
+		Help: "Number of retried calls by method and the status code of the failed attempt",
+	}, []string{"grpc_method", "grpc_code"})
+
+	rejectedCounter = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "grpcutil_server_rejected_total",
+		Help: "Number of calls rejected by the server limits by method and limit",
+	}, []string{"grpc_method", "limit"})
+
+	authzDeniedCounter = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "grpcutil_server_authz_denied_total",
+		Help: "Number of calls denied by the authorization policy by method and status code",
+	}, []string{"grpc_method", "grpc_code"})
+
+	connectionStateGauge = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "grpcutil_client_connections",
+		Help: "Number of client connections by endpoint and connectivity state",
+	}, []string{"endpoint", "state"})
+
+	connectionStateCounter = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "grpcutil_client_connection_state_changes_total",
+		Help: "Number of client connection state changes by endpoint and new state",
+	}, []string{"endpoint", "state"})
+)
+
+func init() {
+	prometheus.MustRegister(certReloadCounter, certExpiryGauge, retryCounter, rejectedCounter, authzDeniedCounter,
+		connectionStateGauge, connectionStateCounter)
+}
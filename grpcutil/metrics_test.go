@@ -0,0 +1,84 @@
+package grpcutil
+
+//
+//Copyright 2019 Telenor Digital AS
+//
+//Licensed under the Apache License, Version 2.0 (the "License");
+//you may not use this file except in compliance with the License.
+//You may obtain a copy of the License at
+//
+//http://www.apache.org/licenses/LICENSE-2.0
+//
+//Unless required by applicable law or agreed to in writing, software
+//distributed under the License is distributed on an "AS IS" BASIS,
+//WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//See the License for the specific language governing permissions and
+//limitations under the License.
+//
+import (
+	"context"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/health/grpc_health_v1"
+)
+
+// TestMain turns on the handling time histograms before any servers or
+// clients are created
+func TestMain(m *testing.M) {
+	EnableHandlingTimeHistograms()
+	os.Exit(m.Run())
+}
+
+// sampleCount returns the number of samples for a counter or histogram in the
+// default registry with the grpc_method label set to the method name.
+func sampleCount(t *testing.T, name, method string) uint64 {
+	families, err := prometheus.DefaultGatherer.Gather()
+	require.NoError(t, err)
+	var ret uint64
+	for _, family := range families {
+		if family.GetName() != name {
+			continue
+		}
+		for _, metric := range family.GetMetric() {
+			for _, label := range metric.GetLabel() {
+				if label.GetName() != "grpc_method" || label.GetValue() != method {
+					continue
+				}
+				if metric.GetCounter() != nil {
+					ret += uint64(metric.GetCounter().GetValue())
+				}
+				if metric.GetHistogram() != nil {
+					ret += metric.GetHistogram().GetSampleCount()
+				}
+			}
+		}
+	}
+	return ret
+}
+
+func TestClientMetrics(t *testing.T) {
+	assert := require.New(t)
+
+	_, conn := NewTestServer(t,
+		GRPCServerParam{Health: true, Metrics: true},
+		GRPCClientParam{Metrics: true},
+		func(s *grpc.Server) {}, nil)
+
+	handled := sampleCount(t, "grpc_client_handled_total", "Check")
+	clientLatency := sampleCount(t, "grpc_client_handling_seconds", "Check")
+	serverLatency := sampleCount(t, "grpc_server_handling_seconds", "Check")
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	_, err := grpc_health_v1.NewHealthClient(conn).Check(ctx, &grpc_health_v1.HealthCheckRequest{})
+	assert.NoError(err)
+
+	assert.Equal(handled+1, sampleCount(t, "grpc_client_handled_total", "Check"))
+	assert.Equal(clientLatency+1, sampleCount(t, "grpc_client_handling_seconds", "Check"))
+	assert.Equal(serverLatency+1, sampleCount(t, "grpc_server_handling_seconds", "Check"))
+}
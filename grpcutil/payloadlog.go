@@ -0,0 +1,292 @@
+package grpcutil
+
+//
+//Copyright 2019 Telenor Digital AS
+//
+//Licensed under the Apache License, Version 2.0 (the "License");
+//you may not use this file except in compliance with the License.
+//You may obtain a copy of the License at
+//
+//http://www.apache.org/licenses/LICENSE-2.0
+//
+//Unless required by applicable law or agreed to in writing, software
+//distributed under the License is distributed on an "AS IS" BASIS,
+//WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//See the License for the specific language governing permissions and
+//limitations under the License.
+//
+import (
+	"context"
+	"io"
+	"log"
+	"path"
+	"sort"
+	"sync"
+	"unicode/utf8"
+
+	"google.golang.org/grpc"
+	"google.golang.org/protobuf/encoding/protojson"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/reflect/protoreflect"
+	"google.golang.org/protobuf/reflect/protoregistry"
+	"google.golang.org/protobuf/types/descriptorpb"
+)
+
+const (
+	// defaultPayloadLogSize is the default maximum size of logged payloads
+	defaultPayloadLogSize = 4096
+
+	// redactedValue replaces the value of redacted string and bytes fields
+	redactedValue = "[REDACTED]"
+
+	// anyFullName is the name of the google.protobuf.Any message
+	anyFullName = "google.protobuf.Any"
+)
+
+// PayloadLogConfig is the configuration for payload loggers
+type PayloadLogConfig struct {
+	Methods      []string                   // Method patterns that are logged initially, ie /package.Service/*
+	RedactFields []string                   // Full names of fields that are redacted, ie package.Message.field
+	RedactOption protoreflect.ExtensionType // Custom bool field option that marks fields as redacted
+	MaxSize      int                        // Maximum number of bytes logged per message. Zero uses 4096.
+}
+
+// PayloadLogger logs the request and response messages for gRPC calls as
+// JSON. Fields are redacted if they are listed in the configuration, if they
+// have the debug_redact option set or if they have the custom redact option
+// set. Payloads that are larger than the maximum size are truncated. Logging
+// is switched on and off per method at runtime with EnableMethod and
+// DisableMethod.
+type PayloadLogger struct {
+	logger       *log.Logger
+	mutex        *sync.RWMutex
+	methods      map[string]bool
+	redactFields map[string]bool
+	redactOption protoreflect.ExtensionType
+	maxSize      int
+}
+
+// NewPayloadLogger creates a new payload logger that writes to the writer.
+// The standard logger's writer is used if the writer is nil.
+func NewPayloadLogger(out io.Writer, config PayloadLogConfig) *PayloadLogger {
+	if out == nil {
+		out = log.Writer()
+	}
+	ret := &PayloadLogger{
+		logger:       log.New(out, "", log.LstdFlags),
+		mutex:        &sync.RWMutex{},
+		methods:      make(map[string]bool),
+		redactFields: make(map[string]bool),
+		redactOption: config.RedactOption,
+		maxSize:      config.MaxSize,
+	}
+	if ret.maxSize <= 0 {
+		ret.maxSize = defaultPayloadLogSize
+	}
+	for _, m := range config.Methods {
+		ret.methods[m] = true
+	}
+	for _, f := range config.RedactFields {
+		ret.redactFields[f] = true
+	}
+	return ret
+}
+
+// EnableMethod turns on payload logging for methods matching the pattern.
+// The pattern is a full method name with wildcards as in path.Match or * for
+// every method.
+func (p *PayloadLogger) EnableMethod(pattern string) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	p.methods[pattern] = true
+}
+
+// DisableMethod turns off payload logging for a pattern that has been
+// enabled earlier
+func (p *PayloadLogger) DisableMethod(pattern string) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	delete(p.methods, pattern)
+}
+
+// Methods returns the enabled method patterns
+func (p *PayloadLogger) Methods() []string {
+	p.mutex.RLock()
+	defer p.mutex.RUnlock()
+	ret := make([]string, 0, len(p.methods))
+	for m := range p.methods {
+		ret = append(ret, m)
+	}
+	sort.Strings(ret)
+	return ret
+}
+
+// Enabled returns true if payloads are logged for the method
+func (p *PayloadLogger) Enabled(method string) bool {
+	p.mutex.RLock()
+	defer p.mutex.RUnlock()
+	if p.methods[method] || p.methods["*"] {
+		return true
+	}
+	for pattern := range p.methods {
+		if matched, _ := path.Match(pattern, method); matched {
+			return true
+		}
+	}
+	return false
+}
+
+// redacted returns true if the field should be redacted
+func (p *PayloadLogger) redacted(fd protoreflect.FieldDescriptor) bool {
+	if p.redactFields[string(fd.FullName())] {
+		return true
+	}
+	opts, ok := fd.Options().(*descriptorpb.FieldOptions)
+	if !ok || opts == nil {
+		return false
+	}
+	if opts.GetDebugRedact() {
+		return true
+	}
+	if p.redactOption == nil || !proto.HasExtension(opts, p.redactOption) {
+		return false
+	}
+	v, ok := proto.GetExtension(opts, p.redactOption).(bool)
+	return ok && v
+}
+
+// redactAny redacts the message in an Any value. protojson expands Any
+// values with registered types so the packed message is unpacked, redacted
+// and packed again. The value is cleared if it can't be unpacked.
+func (p *PayloadLogger) redactAny(m protoreflect.Message) {
+	fields := m.Descriptor().Fields()
+	typeURL := fields.ByName("type_url")
+	value := fields.ByName("value")
+	mt, err := protoregistry.GlobalTypes.FindMessageByURL(m.Get(typeURL).String())
+	if err != nil {
+		// protojson can't expand unknown types either
+		return
+	}
+	inner := mt.New()
+	if err := proto.Unmarshal(m.Get(value).Bytes(), inner.Interface()); err != nil {
+		m.Clear(value)
+		return
+	}
+	p.redact(inner)
+	buf, err := proto.Marshal(inner.Interface())
+	if err != nil {
+		m.Clear(value)
+		return
+	}
+	m.Set(value, protoreflect.ValueOfBytes(buf))
+}
+
+// redact masks the redacted fields in the message and its sub-messages,
+// including messages packed in Any values. Singular string and bytes fields
+// are replaced with a marker while other fields are cleared.
+func (p *PayloadLogger) redact(m protoreflect.Message) {
+	if m.Descriptor().FullName() == anyFullName {
+		p.redactAny(m)
+		return
+	}
+	m.Range(func(fd protoreflect.FieldDescriptor, v protoreflect.Value) bool {
+		switch {
+		case p.redacted(fd):
+			switch {
+			case fd.IsList() || fd.IsMap():
+				m.Clear(fd)
+			case fd.Kind() == protoreflect.StringKind:
+				m.Set(fd, protoreflect.ValueOfString(redactedValue))
+			case fd.Kind() == protoreflect.BytesKind:
+				m.Set(fd, protoreflect.ValueOfBytes([]byte(redactedValue)))
+			default:
+				m.Clear(fd)
+			}
+		case fd.IsList() && fd.Message() != nil:
+			list := v.List()
+			for i := 0; i < list.Len(); i++ {
+				p.redact(list.Get(i).Message())
+			}
+		case fd.IsMap() && fd.MapValue().Message() != nil:
+			v.Map().Range(func(_ protoreflect.MapKey, mv protoreflect.Value) bool {
+				p.redact(mv.Message())
+				return true
+			})
+		case !fd.IsMap() && fd.Message() != nil:
+			p.redact(v.Message())
+		}
+		return true
+	})
+}
+
+// Payload returns the message as redacted and truncated JSON
+func (p *PayloadLogger) Payload(msg interface{}) string {
+	pm, ok := msg.(proto.Message)
+	if !ok {
+		return "<not a protobuf message>"
+	}
+	clone := proto.Clone(pm)
+	p.redact(clone.ProtoReflect())
+	buf, err := protojson.MarshalOptions{}.Marshal(clone)
+	if err != nil {
+		return "<" + err.Error() + ">"
+	}
+	if len(buf) > p.maxSize {
+		n := p.maxSize
+		for n > 0 && !utf8.RuneStart(buf[n]) {
+			n--
+		}
+		return string(buf[:n]) + "...<truncated>"
+	}
+	return string(buf)
+}
+
+func (p *PayloadLogger) log(ctx context.Context, method, direction string, msg interface{}) {
+	p.logger.Printf("%s %s (peer %s): %s", method, direction, peerAddress(ctx), p.Payload(msg))
+}
+
+// payloadStream logs the messages sent and received on a stream
+type payloadStream struct {
+	grpc.ServerStream
+	logger *PayloadLogger
+	method string
+}
+
+func (s *payloadStream) RecvMsg(m interface{}) error {
+	err := s.ServerStream.RecvMsg(m)
+	if err == nil {
+		s.logger.log(s.Context(), s.method, "request", m)
+	}
+	return err
+}
+
+func (s *payloadStream) SendMsg(m interface{}) error {
+	s.logger.log(s.Context(), s.method, "response", m)
+	return s.ServerStream.SendMsg(m)
+}
+
+// PayloadLogInterceptor returns interceptors that log the request and
+// response messages for the methods that are enabled in the payload logger.
+// Add it after the authentication interceptor so calls that fail
+// authentication don't end up in the log.
+func PayloadLogInterceptor(logger *PayloadLogger) ServerInterceptor {
+	return ServerInterceptor{
+		Unary: func(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+			if !logger.Enabled(info.FullMethod) {
+				return handler(ctx, req)
+			}
+			logger.log(ctx, info.FullMethod, "request", req)
+			resp, err := handler(ctx, req)
+			if err == nil {
+				logger.log(ctx, info.FullMethod, "response", resp)
+			}
+			return resp, err
+		},
+		Stream: func(srv interface{}, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+			if !logger.Enabled(info.FullMethod) {
+				return handler(srv, ss)
+			}
+			return handler(srv, &payloadStream{ServerStream: ss, logger: logger, method: info.FullMethod})
+		},
+	}
+}
@@ -0,0 +1,222 @@
+package grpcutil
+
+//
+//Copyright 2019 Telenor Digital AS
+//
+//Licensed under the Apache License, Version 2.0 (the "License");
+//you may not use this file except in compliance with the License.
+//You may obtain a copy of the License at
+//
+//http://www.apache.org/licenses/LICENSE-2.0
+//
+//Unless required by applicable law or agreed to in writing, software
+//distributed under the License is distributed on an "AS IS" BASIS,
+//WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//See the License for the specific language governing permissions and
+//limitations under the License.
+//
+import (
+	"context"
+	"encoding/json"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	statuspb "google.golang.org/genproto/googleapis/rpc/status"
+	"google.golang.org/grpc/health/grpc_health_v1"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/reflect/protodesc"
+	"google.golang.org/protobuf/reflect/protoreflect"
+	"google.golang.org/protobuf/reflect/protoregistry"
+	"google.golang.org/protobuf/types/descriptorpb"
+	"google.golang.org/protobuf/types/dynamicpb"
+	"google.golang.org/protobuf/types/known/anypb"
+)
+
+// testRedactMessage builds a message type with a field marked with
+// debug_redact, a field marked with a custom option and a nested message.
+// The custom option is returned as an extension type.
+func testRedactMessage(t *testing.T) (protoreflect.MessageDescriptor, protoreflect.ExtensionType) {
+	optionFile, err := protodesc.NewFile(&descriptorpb.FileDescriptorProto{
+		Name:       proto.String("redact_option.proto"),
+		Package:    proto.String("test.options"),
+		Syntax:     proto.String("proto3"),
+		Dependency: []string{"google/protobuf/descriptor.proto"},
+		Extension: []*descriptorpb.FieldDescriptorProto{{
+			Name:     proto.String("secret"),
+			Number:   proto.Int32(50000),
+			Label:    descriptorpb.FieldDescriptorProto_LABEL_OPTIONAL.Enum(),
+			Type:     descriptorpb.FieldDescriptorProto_TYPE_BOOL.Enum(),
+			Extendee: proto.String(".google.protobuf.FieldOptions"),
+			JsonName: proto.String("secret"),
+		}},
+	}, protoregistry.GlobalFiles)
+	require.NoError(t, err)
+	secretOption := dynamicpb.NewExtensionType(optionFile.Extensions().Get(0))
+
+	customOpts := &descriptorpb.FieldOptions{}
+	proto.SetExtension(customOpts, secretOption, true)
+
+	field := func(name string, number int32, typ descriptorpb.FieldDescriptorProto_Type, opts *descriptorpb.FieldOptions) *descriptorpb.FieldDescriptorProto {
+		return &descriptorpb.FieldDescriptorProto{
+			Name:     proto.String(name),
+			Number:   proto.Int32(number),
+			Label:    descriptorpb.FieldDescriptorProto_LABEL_OPTIONAL.Enum(),
+			Type:     typ.Enum(),
+			JsonName: proto.String(name),
+			Options:  opts,
+		}
+	}
+	inner := field("inner", 5, descriptorpb.FieldDescriptorProto_TYPE_MESSAGE, nil)
+	inner.TypeName = proto.String(".test.Login")
+
+	file, err := protodesc.NewFile(&descriptorpb.FileDescriptorProto{
+		Name:    proto.String("login.proto"),
+		Package: proto.String("test"),
+		Syntax:  proto.String("proto3"),
+		MessageType: []*descriptorpb.DescriptorProto{{
+			Name: proto.String("Login"),
+			Field: []*descriptorpb.FieldDescriptorProto{
+				field("user", 1, descriptorpb.FieldDescriptorProto_TYPE_STRING, nil),
+				field("password", 2, descriptorpb.FieldDescriptorProto_TYPE_STRING, &descriptorpb.FieldOptions{DebugRedact: proto.Bool(true)}),
+				field("token", 3, descriptorpb.FieldDescriptorProto_TYPE_STRING, customOpts),
+				field("pin", 4, descriptorpb.FieldDescriptorProto_TYPE_INT32, nil),
+				inner,
+			},
+		}},
+	}, protoregistry.GlobalFiles)
+	require.NoError(t, err)
+	return file.Messages().Get(0), secretOption
+}
+
+func TestPayloadRedaction(t *testing.T) {
+	assert := require.New(t)
+
+	desc, secretOption := testRedactMessage(t)
+	newLogin := func(user string) *dynamicpb.Message {
+		m := dynamicpb.NewMessage(desc)
+		m.Set(desc.Fields().ByName("user"), protoreflect.ValueOfString(user))
+		m.Set(desc.Fields().ByName("password"), protoreflect.ValueOfString("hunter2"))
+		m.Set(desc.Fields().ByName("token"), protoreflect.ValueOfString("secret-token"))
+		m.Set(desc.Fields().ByName("pin"), protoreflect.ValueOfInt32(1234))
+		return m
+	}
+	msg := newLogin("alice")
+	msg.Set(desc.Fields().ByName("inner"), protoreflect.ValueOfMessage(newLogin("bob")))
+
+	logger := NewPayloadLogger(nil, PayloadLogConfig{
+		RedactFields: []string{"test.Login.pin"},
+		RedactOption: secretOption,
+	})
+	var payload map[string]interface{}
+	assert.NoError(json.Unmarshal([]byte(logger.Payload(msg)), &payload))
+	assert.Equal("alice", payload["user"])
+	assert.Equal(redactedValue, payload["password"])
+	assert.Equal(redactedValue, payload["token"])
+	assert.NotContains(payload, "pin")
+
+	inner := payload["inner"].(map[string]interface{})
+	assert.Equal("bob", inner["user"])
+	assert.Equal(redactedValue, inner["password"])
+	assert.Equal(redactedValue, inner["token"])
+
+	// The original message is unchanged
+	assert.Equal("hunter2", msg.Get(desc.Fields().ByName("password")).String())
+
+	// Without the custom option only debug_redact and the field list are used
+	logger = NewPayloadLogger(nil, PayloadLogConfig{})
+	assert.Contains(logger.Payload(msg), "secret-token")
+	assert.NotContains(logger.Payload(msg), "hunter2")
+
+	assert.Equal("<not a protobuf message>", logger.Payload("text"))
+}
+
+func TestPayloadRedactionInAny(t *testing.T) {
+	assert := require.New(t)
+
+	logger := NewPayloadLogger(nil, PayloadLogConfig{
+		RedactFields: []string{"grpc.health.v1.HealthCheckRequest.service"},
+	})
+	req := &grpc_health_v1.HealthCheckRequest{Service: "secret"}
+	packed, err := anypb.New(req)
+	assert.NoError(err)
+	nested, err := anypb.New(packed)
+	assert.NoError(err)
+	msg := &statuspb.Status{Message: "failed", Details: []*anypb.Any{packed, nested}}
+
+	for _, m := range []proto.Message{packed, nested, msg} {
+		payload := logger.Payload(m)
+		assert.NotContains(payload, "secret")
+		assert.Contains(payload, redactedValue)
+	}
+	// The logged message isn't modified
+	unpacked := &grpc_health_v1.HealthCheckRequest{}
+	assert.NoError(packed.UnmarshalTo(unpacked))
+	assert.Equal("secret", unpacked.Service)
+
+	// Values that can't be unpacked are cleared
+	broken := &anypb.Any{TypeUrl: packed.TypeUrl, Value: []byte("\xff")}
+	assert.Equal(`{"@type":"`+packed.TypeUrl+`"}`, strings.ReplaceAll(logger.Payload(broken), " ", ""))
+}
+
+func TestPayloadTruncation(t *testing.T) {
+	assert := require.New(t)
+
+	logger := NewPayloadLogger(nil, PayloadLogConfig{MaxSize: 20})
+	payload := logger.Payload(&grpc_health_v1.HealthCheckRequest{Service: strings.Repeat("æ", 20)})
+	assert.True(strings.HasSuffix(payload, "...<truncated>"), payload)
+	truncated := strings.TrimSuffix(payload, "...<truncated>")
+	assert.True(len(truncated) <= 20)
+	assert.True(strings.HasSuffix(truncated, "æ"), truncated)
+}
+
+func TestPayloadLogInterceptor(t *testing.T) {
+	assert := require.New(t)
+
+	out := &syncBuffer{}
+	logger := NewPayloadLogger(out, PayloadLogConfig{
+		RedactFields: []string{"grpc.health.v1.HealthCheckRequest.service"},
+	})
+	serverOpts := chainInterceptors([]ServerInterceptor{PayloadLogInterceptor(logger)})
+	_, conn := NewTestServer(t, GRPCServerParam{Health: true}, GRPCClientParam{}, registerEcho, serverOpts)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	lines := func() []string {
+		out.mutex.Lock()
+		defer out.mutex.Unlock()
+		return strings.Split(strings.TrimSpace(out.buf.String()), "\n")
+	}
+
+	// Nothing is logged until the method is enabled
+	assert.NoError(conn.Invoke(ctx, "/test.Echo/Echo", &grpc_health_v1.HealthCheckRequest{Service: "secret"}, &grpc_health_v1.HealthCheckResponse{}))
+	assert.Equal([]string{""}, lines())
+
+	logger.EnableMethod("/test.Echo/*")
+	assert.Equal([]string{"/test.Echo/*"}, logger.Methods())
+	assert.NoError(conn.Invoke(ctx, "/test.Echo/Echo", &grpc_health_v1.HealthCheckRequest{Service: "secret"}, &grpc_health_v1.HealthCheckResponse{}))
+	logged := lines()
+	assert.Len(logged, 2)
+	assert.Contains(logged[0], "/test.Echo/Echo request")
+	assert.Contains(logged[0], redactedValue)
+	assert.NotContains(logged[0], "secret")
+	assert.Contains(logged[1], "/test.Echo/Echo response")
+	assert.Contains(logged[1], "SERVING")
+
+	// Streams are logged too
+	logger.EnableMethod("*")
+	stream, err := grpc_health_v1.NewHealthClient(conn).Watch(ctx, &grpc_health_v1.HealthCheckRequest{})
+	assert.NoError(err)
+	_, err = stream.Recv()
+	assert.NoError(err)
+	assert.Eventually(func() bool { return len(lines()) == 4 }, 5*time.Second, 10*time.Millisecond)
+	assert.Contains(lines()[3], "/grpc.health.v1.Health/Watch response")
+
+	logger.DisableMethod("*")
+	logger.DisableMethod("/test.Echo/*")
+	assert.False(logger.Enabled("/test.Echo/Echo"))
+	assert.NoError(callEcho(ctx, conn))
+	assert.Len(lines(), 4)
+}
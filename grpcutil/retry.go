@@ -0,0 +1,137 @@
+package grpcutil
+
+//
+//Copyright 2019 Telenor Digital AS
+//
+//Licensed under the Apache License, Version 2.0 (the "License");
+//you may not use this file except in compliance with the License.
+//You may obtain a copy of the License at
+//
+//http://www.apache.org/licenses/LICENSE-2.0
+//
+//Unless required by applicable law or agreed to in writing, software
+//distributed under the License is distributed on an "AS IS" BASIS,
+//WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//See the License for the specific language governing permissions and
+//limitations under the License.
+//
+import (
+	"context"
+	"fmt"
+	"math/rand"
+	"strings"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// RetryPolicy is the retry policy for unary calls. Calls that fail with one
+// of the status codes are retried until the maximum number of attempts is
+// reached. The time between attempts is a random duration up to the backoff,
+// which starts at the initial backoff and is multiplied by the backoff
+// multiplier for each attempt until it reaches the maximum backoff. A
+// multiplier below 1 (ie zero when it isn't set) keeps the backoff constant.
+type RetryPolicy struct {
+	MaxAttempts       int
+	InitialBackoff    time.Duration
+	MaxBackoff        time.Duration
+	BackoffMultiplier float64
+	Codes             []codes.Code
+}
+
+// retryable returns true if the code is in the list of retryable codes
+func (r RetryPolicy) retryable(code codes.Code) bool {
+	for _, c := range r.Codes {
+		if c == code {
+			return true
+		}
+	}
+	return false
+}
+
+// nextBackoff returns the backoff for the next attempt. Multipliers below 1
+// keep the backoff constant.
+func (r RetryPolicy) nextBackoff(backoff time.Duration) time.Duration {
+	multiplier := r.BackoffMultiplier
+	if multiplier < 1 {
+		multiplier = 1
+	}
+	next := time.Duration(float64(backoff) * multiplier)
+	if r.MaxBackoff > 0 && next > r.MaxBackoff {
+		return r.MaxBackoff
+	}
+	return next
+}
+
+// jitter returns a random duration between zero and the backoff
+func jitter(backoff time.Duration) time.Duration {
+	if backoff <= 0 {
+		return 0
+	}
+	return time.Duration(rand.Int63n(int64(backoff)))
+}
+
+// ParseCode parses a status code name like UNAVAILABLE or DeadlineExceeded
+func ParseCode(name string) (codes.Code, error) {
+	name = strings.ReplaceAll(strings.TrimSpace(name), "_", "")
+	for c := codes.OK; c <= codes.Unauthenticated; c++ {
+		if strings.EqualFold(name, c.String()) {
+			return c, nil
+		}
+	}
+	return codes.Unknown, fmt.Errorf("unknown status code: %s", name)
+}
+
+// retryPolicy returns the retry policy from the client parameters
+func retryPolicy(config GRPCClientParam) (RetryPolicy, error) {
+	ret := RetryPolicy{
+		MaxAttempts:       config.RetryMaxAttempts,
+		InitialBackoff:    config.RetryInitialBackoff,
+		MaxBackoff:        config.RetryMaxBackoff,
+		BackoffMultiplier: config.RetryBackoffMultiplier,
+	}
+	for _, name := range config.RetryCodes {
+		code, err := ParseCode(name)
+		if err != nil {
+			return ret, err
+		}
+		ret.Codes = append(ret.Codes, code)
+	}
+	return ret, nil
+}
+
+// RetryInterceptor returns a client interceptor that retries unary calls.
+// The method policies override the default policy for single methods and are
+// keyed on the full method name, ie /package.Service/Method. Streaming calls
+// are not retried. If the server includes a retry hint that is longer than
+// the backoff the client waits for the hinted delay. Retries are counted in
+// the grpcutil_client_retries_total metric.
+func RetryInterceptor(defaultPolicy RetryPolicy, methodPolicies map[string]RetryPolicy) grpc.UnaryClientInterceptor {
+	return func(ctx context.Context, method string, req, reply interface{}, cc *grpc.ClientConn, invoker grpc.UnaryInvoker, opts ...grpc.CallOption) error {
+		policy, ok := methodPolicies[method]
+		if !ok {
+			policy = defaultPolicy
+		}
+		backoff := policy.InitialBackoff
+		for attempt := 1; ; attempt++ {
+			err := invoker(ctx, method, req, reply, cc, opts...)
+			code := status.Code(err)
+			if err == nil || attempt >= policy.MaxAttempts || !policy.retryable(code) {
+				return err
+			}
+			retryCounter.WithLabelValues(method, code.String()).Inc()
+			delay := jitter(backoff)
+			if hint, ok := RetryDelay(err); ok && hint > delay {
+				delay = hint
+			}
+			select {
+			case <-time.After(delay):
+			case <-ctx.Done():
+				return err
+			}
+			backoff = policy.nextBackoff(backoff)
+		}
+	}
+}
@@ -0,0 +1,131 @@
+package grpcutil
+
+//
+//Copyright 2019 Telenor Digital AS
+//
+//Licensed under the Apache License, Version 2.0 (the "License");
+//you may not use this file except in compliance with the License.
+//You may obtain a copy of the License at
+//
+//http://www.apache.org/licenses/LICENSE-2.0
+//
+//Unless required by applicable law or agreed to in writing, software
+//distributed under the License is distributed on an "AS IS" BASIS,
+//WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//See the License for the specific language governing permissions and
+//limitations under the License.
+//
+import (
+	"context"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/health/grpc_health_v1"
+	"google.golang.org/grpc/status"
+)
+
+const healthCheckMethod = "/grpc.health.v1.Health/Check"
+
+// failingInterceptor fails the first n calls with the status code
+func failingInterceptor(n int32, code codes.Code, calls *int32) grpc.ServerOption {
+	return grpc.ChainUnaryInterceptor(func(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+		if atomic.AddInt32(calls, 1) <= n {
+			return nil, status.Error(code, "failed")
+		}
+		return handler(ctx, req)
+	})
+}
+
+func TestParseCode(t *testing.T) {
+	assert := require.New(t)
+
+	for name, expected := range map[string]codes.Code{
+		"UNAVAILABLE":         codes.Unavailable,
+		"DEADLINE_EXCEEDED":   codes.DeadlineExceeded,
+		"ResourceExhausted":   codes.ResourceExhausted,
+		" ok ":                codes.OK,
+		"unauthenticated":     codes.Unauthenticated,
+		"FAILED_PRECONDITION": codes.FailedPrecondition,
+	} {
+		code, err := ParseCode(name)
+		assert.NoError(err)
+		assert.Equal(expected, code, name)
+	}
+	_, err := ParseCode("NOT_A_CODE")
+	assert.Error(err)
+}
+
+func TestRetry(t *testing.T) {
+	assert := require.New(t)
+
+	var calls int32
+	clientConfig := GRPCClientParam{
+		RetryMaxAttempts:       3,
+		RetryInitialBackoff:    time.Millisecond,
+		RetryMaxBackoff:        10 * time.Millisecond,
+		RetryBackoffMultiplier: 2,
+		RetryCodes:             []string{"UNAVAILABLE"},
+	}
+	_, conn := NewTestServer(t, GRPCServerParam{Health: true}, clientConfig, func(s *grpc.Server) {},
+		[]grpc.ServerOption{failingInterceptor(2, codes.Unavailable, &calls)})
+	client := grpc_health_v1.NewHealthClient(conn)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	retries := testutil.ToFloat64(retryCounter.WithLabelValues(healthCheckMethod, codes.Unavailable.String()))
+	_, err := client.Check(ctx, &grpc_health_v1.HealthCheckRequest{})
+	assert.NoError(err)
+	assert.Equal(int32(3), atomic.LoadInt32(&calls))
+	assert.Equal(retries+2, testutil.ToFloat64(retryCounter.WithLabelValues(healthCheckMethod, codes.Unavailable.String())))
+
+	// Give up after the maximum number of attempts
+	atomic.StoreInt32(&calls, -10)
+	_, err = client.Check(ctx, &grpc_health_v1.HealthCheckRequest{})
+	assert.Equal(codes.Unavailable, status.Code(err))
+	assert.Equal(int32(-7), atomic.LoadInt32(&calls))
+}
+
+func TestRetryCodesAndOverrides(t *testing.T) {
+	assert := require.New(t)
+
+	var calls int32
+	clientConfig := GRPCClientParam{
+		RetryMaxAttempts: 3,
+		RetryCodes:       []string{"UNAVAILABLE"},
+		RetryMethods: map[string]RetryPolicy{
+			healthCheckMethod: {MaxAttempts: 5, Codes: []codes.Code{codes.Aborted}},
+		},
+	}
+	_, conn := NewTestServer(t, GRPCServerParam{Health: true}, clientConfig, func(s *grpc.Server) {},
+		[]grpc.ServerOption{failingInterceptor(4, codes.Aborted, &calls)})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	_, err := grpc_health_v1.NewHealthClient(conn).Check(ctx, &grpc_health_v1.HealthCheckRequest{})
+	assert.NoError(err)
+	assert.Equal(int32(5), atomic.LoadInt32(&calls))
+
+	_, err = GetDialOpts(GRPCClientParam{RetryMaxAttempts: 2, RetryCodes: []string{"SOMETIMES"}})
+	assert.Error(err)
+}
+
+func TestBackoff(t *testing.T) {
+	assert := require.New(t)
+
+	policy := RetryPolicy{BackoffMultiplier: 2, MaxBackoff: 300 * time.Millisecond}
+	assert.Equal(200*time.Millisecond, policy.nextBackoff(100*time.Millisecond))
+	assert.Equal(300*time.Millisecond, policy.nextBackoff(200*time.Millisecond))
+
+	// Unset multipliers keep the backoff constant
+	policy = RetryPolicy{}
+	assert.Equal(100*time.Millisecond, policy.nextBackoff(100*time.Millisecond))
+	policy.BackoffMultiplier = 0.5
+	assert.Equal(100*time.Millisecond, policy.nextBackoff(100*time.Millisecond))
+}
@@ -16,14 +16,20 @@ package grpcutil
 //limitations under the License.
 //
 import (
+	"context"
 	"errors"
 	"log"
 	"net"
+	"net/http"
+	"sync"
 	"time"
 
 	grpc_prometheus "github.com/grpc-ecosystem/go-grpc-prometheus"
 	"google.golang.org/grpc"
 	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/health"
+	"google.golang.org/grpc/health/grpc_health_v1"
+	"google.golang.org/grpc/keepalive"
 )
 
 // GRPCServer is the common interface for GRPC servers
@@ -32,132 +38,530 @@ type GRPCServer interface {
 	Start(registerFunc func(s *grpc.Server)) error
 
 	// StartWithOpts launches a new server with additional server options. Use
-	// GetServerOpts to get the default set of options.
+	// ServerOpts to get the default set of options.
 	StartWithOpts(registerFunc func(s *grpc.Server), opts []grpc.ServerOption) error
 
-	// Launch launches the server in the background
+	// Launch launches the server in the background. It returns when the
+	// server is serving requests or with an error if the server fails or
+	// isn't serving within the timeout. Use Wait or Done to get errors after
+	// the server has launched.
 	Launch(registerFunc func(s *grpc.Server), timeout time.Duration) error
 
 	// LaunchWithOpts launches the server in the background with addtional server options
 	LaunchWithOpts(registerFunc func(s *grpc.Server), timeout time.Duration, opts []grpc.ServerOption) error
 
-	// Endpoint returns the server's endpoint
+	// Done returns a channel that is closed when the server stops serving.
+	Done() <-chan struct{}
+
+	// Err returns the error that made the server stop serving. The error is
+	// nil while the server is running and when it's stopped with Stop or
+	// GracefulStop.
+	Err() error
+
+	// Wait blocks until the server stops serving and returns the error from
+	// Err.
+	Wait() error
+
+	// ListenAddress returns the server's listen address. This is a
+	// *net.UnixAddr for Unix domain sockets. Use ClientEndpoint to get the
+	// endpoint for clients. The address is nil if the server isn't bound.
 	ListenAddress() net.Addr
 
+	// Bind creates the listener for servers created with
+	// NewUnboundGRPCServer. Servers that aren't bound are bound when they
+	// start. Bind does nothing if the server is already bound.
+	Bind() error
+
 	// Stop shuts down the server
 	Stop()
+
+	// GracefulStop stops the server from accepting new connections and RPCs
+	// and waits for the in-flight RPCs to complete. If the context is done
+	// before the RPCs complete the server is stopped forcefully and the
+	// context error is returned. The health status is set to NOT_SERVING
+	// before the server stops.
+	GracefulStop(ctx context.Context) error
+
+	// SetHealthServer replaces the built-in health server. Use this if the
+	// health service is registered by the register function rather than
+	// through the Health parameter.
+	SetHealthServer(healthServer *health.Server)
+
+	// SetServingStatus sets the health status for a service. An empty service
+	// name sets the status for the whole server.
+	SetServingStatus(service string, status grpc_health_v1.HealthCheckResponse_ServingStatus)
+
+	// SetHTTPHandler makes the server serve both gRPC and HTTP requests on the
+	// listener. Requests with the content type application/grpc are served
+	// by the gRPC server and all other requests by the handler. With TLS both
+	// HTTP/2 and HTTP/1.1 are negotiated, without TLS HTTP/2 is served as h2c.
+	// If the JSONGateway parameter is set JSON requests for unary methods are
+	// served by the gateway before they reach the handler. The handler must
+	// be set before the server is started.
+	//
+	// gRPC requests are then served through grpc.Server.ServeHTTP rather than
+	// the gRPC transport. The TLS settings from the parameters are used but
+	// credentials in the server options (grpc.Creds) are ignored. The
+	// maximum connection idle time is applied to the HTTP/2 server, while the
+	// keepalive settings and the maximum connection age aren't supported.
+	SetHTTPHandler(handler http.Handler)
+
+	// AddInterceptors adds unary and stream interceptors to the server. The
+	// interceptors run after the interceptors in the server options (ie after
+	// the metrics interceptors) in the order they are added. Interceptors must
+	// be added before the server is started.
+	AddInterceptors(interceptors ...ServerInterceptor)
+
+	// Serving returns true if the server is serving and the health status for
+	// the whole server is SERVING. It returns false before the server is
+	// serving and after it has stopped. Use this as the health check for the
+	// monitoring server to make the HTTP and gRPC health probes agree.
+	Serving() bool
+
+	// ServerOpts returns the default set of options for the server. The TLS
+	// certificate in the options is reloaded by the server.
+	ServerOpts() ([]grpc.ServerOption, error)
+
+	// ReloadCertificates reloads the TLS certificate and key files. New
+	// connections will use the reloaded certificate. The current certificate
+	// is kept if the files can't be loaded.
+	ReloadCertificates() error
 }
 
-// NewGRPCServer configures a new GRPC server. A port will be allocated for the server
+// NewGRPCServer configures a new GRPC server. A port will be allocated for the
+// server. The endpoint is either host:port for TCP, unix:path or
+// unix:///absolute/path for Unix domain sockets, or unix-abstract:name for
+// abstract Unix domain sockets.
 func NewGRPCServer(params GRPCServerParam) (GRPCServer, error) {
-	ret := grpcServer{config: params}
-
-	var err error
-	ret.listener, err = net.Listen("tcp", ret.config.Endpoint)
+	listener, err := listen(params.Endpoint, params.SocketMode)
 	if err != nil {
 		return nil, err
 	}
-	return &ret, nil
+	return NewGRPCServerWithListener(params, listener)
+}
+
+// NewUnboundGRPCServer configures a new GRPC server without binding the
+// endpoint. The server is bound when Bind is called or when the server
+// starts. Use this to wire up the server before the port is allocated.
+func NewUnboundGRPCServer(params GRPCServerParam) (GRPCServer, error) {
+	return NewGRPCServerWithListener(params, nil)
+}
+
+// NewGRPCServerWithListener configures a new GRPC server that serves on an
+// existing listener. The Endpoint parameter is ignored.
+func NewGRPCServerWithListener(params GRPCServerParam, listener net.Listener) (GRPCServer, error) {
+	return &grpcServer{
+		config:   params,
+		listener: listener,
+		mutex:    &sync.Mutex{},
+		health:   health.NewServer(),
+		stop:     make(chan struct{}),
+		ready:    make(chan struct{}),
+		done:     make(chan struct{}),
+		once:     &sync.Once{},
+	}, nil
 }
 
 type grpcServer struct {
 	config   GRPCServerParam
 	listener net.Listener
 	server   *grpc.Server
+	mutex    *sync.Mutex
+	certs    *certReloader
+	health   *health.Server
+	stop     chan struct{}
+	ready    chan struct{}
+	done     chan struct{}
+	once     *sync.Once
+	err      error
+
+	interceptors []ServerInterceptor
+
+	httpHandler http.Handler
+	httpServer  *http.Server
+	mux         *httpMux
 }
 
-// GetServerOpts returns the server options. Note that the options might
-// include an unary interceptor if the metrics flag is set (there can be only
-// one per server) so if you use additional unary interceptors you have to chain
-// them yourself.
+// GetServerOpts returns the server options. The metrics interceptors are
+// added as chained interceptors so additional interceptors can be added with
+// grpc.ChainUnaryInterceptor and grpc.ChainStreamInterceptor or through the
+// server's AddInterceptors method. The limit interceptor isn't included since
+// the server adds it after the other interceptors.
 func GetServerOpts(config GRPCServerParam) ([]grpc.ServerOption, error) {
+	return serverOpts(config, nil)
+}
+
+// serverOpts returns the server options with the certificate from the
+// reloader. The certificate is loaded from the config if the reloader is nil.
+func serverOpts(config GRPCServerParam, certs *certReloader) ([]grpc.ServerOption, error) {
 	opts := make([]grpc.ServerOption, 0)
+	if config.RecoverPanics {
+		opts = append(opts, chainInterceptors([]ServerInterceptor{RecoveryInterceptor()})...)
+	}
 	if config.Metrics {
-		opts = append(opts, grpc.StreamInterceptor(grpc_prometheus.StreamServerInterceptor))
-		opts = append(opts, grpc.UnaryInterceptor(grpc_prometheus.UnaryServerInterceptor))
+		opts = append(opts, grpc.ChainStreamInterceptor(grpc_prometheus.StreamServerInterceptor))
+		opts = append(opts, grpc.ChainUnaryInterceptor(grpc_prometheus.UnaryServerInterceptor))
 	}
+	opts = append(opts, grpc.KeepaliveParams(keepalive.ServerParameters{
+		MaxConnectionIdle:     config.MaxConnectionIdle,
+		MaxConnectionAge:      config.MaxConnectionAge,
+		MaxConnectionAgeGrace: config.MaxConnectionAgeGrace,
+		Time:                  config.KeepaliveTime,
+		Timeout:               config.KeepaliveTimeout,
+	}))
+	opts = append(opts, grpc.KeepaliveEnforcementPolicy(keepalive.EnforcementPolicy{
+		MinTime:             config.KeepaliveMinTime,
+		PermitWithoutStream: config.KeepalivePermitWithoutStream,
+	}))
 	if !config.TLS {
 		return opts, nil
 	}
-	if config.CertFile == "" || config.KeyFile == "" {
-		return nil, errors.New("missing cert file and key file parameters for GRPC server")
+	if certs == nil {
+		var err error
+		certs, err = loadServerCertificate(config, nil)
+		if err != nil {
+			return nil, err
+		}
 	}
-	creds, err := credentials.NewServerTLSFromFile(config.CertFile, config.KeyFile)
+	tlsConfig, err := serverTLSConfig(config, certs)
 	if err != nil {
 		return nil, err
 	}
-	opts = append(opts, grpc.Creds(creds))
+	opts = append(opts, grpc.Creds(credentials.NewTLS(tlsConfig)))
 	return opts, nil
 }
 
-func (g *grpcServer) registerMetrics() {
+// loadCertificates loads the server certificate and launches the watcher if
+// the reload interval is set. The certificate is only loaded once.
+func (g *grpcServer) loadCertificates() (*certReloader, error) {
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+	if g.certs != nil {
+		return g.certs, nil
+	}
+	var addr net.Addr
+	if g.listener != nil {
+		addr = g.listener.Addr()
+	}
+	certs, err := loadServerCertificate(g.config, addr)
+	if err != nil {
+		return nil, err
+	}
+	g.certs = certs
+	if g.config.CertReloadInterval > 0 {
+		go certs.Watch(g.config.CertReloadInterval, g.stop)
+	}
+	return certs, nil
+}
+
+func (g *grpcServer) ServerOpts() ([]grpc.ServerOption, error) {
+	if !g.config.TLS {
+		return serverOpts(g.config, nil)
+	}
+	certs, err := g.loadCertificates()
+	if err != nil {
+		return nil, err
+	}
+	return serverOpts(g.config, certs)
+}
+
+func (g *grpcServer) ReloadCertificates() error {
+	if !g.config.TLS {
+		return errors.New("TLS is not enabled for the server")
+	}
+	g.mutex.Lock()
+	certs := g.certs
+	g.mutex.Unlock()
+	if certs == nil {
+		_, err := g.loadCertificates()
+		return err
+	}
+	return certs.Reload()
+}
+
+func (g *grpcServer) registerMetrics(server *grpc.Server) {
 	if g.config.Metrics {
-		grpc_prometheus.Register(g.server)
+		grpc_prometheus.Register(server)
+	}
+}
+
+func (g *grpcServer) registerHealth(server *grpc.Server) {
+	if g.config.Health {
+		g.mutex.Lock()
+		defer g.mutex.Unlock()
+		grpc_health_v1.RegisterHealthServer(server, g.health)
+	}
+}
+
+func (g *grpcServer) SetHTTPHandler(handler http.Handler) {
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+	g.httpHandler = handler
+}
+
+func (g *grpcServer) AddInterceptors(interceptors ...ServerInterceptor) {
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+	g.interceptors = append(g.interceptors, interceptors...)
+}
+
+// interceptorOpts returns the server options for the interceptors added with
+// AddInterceptors.
+func (g *grpcServer) interceptorOpts() []grpc.ServerOption {
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+	return chainInterceptors(g.interceptors)
+}
+
+func (g *grpcServer) Bind() error {
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+	if g.listener != nil {
+		return nil
+	}
+	select {
+	case <-g.stop:
+		return errors.New("gRPC server is stopped")
+	default:
+	}
+	listener, err := listen(g.config.Endpoint, g.config.SocketMode)
+	if err != nil {
+		return err
 	}
+	g.listener = listener
+	return nil
 }
 
 func (g *grpcServer) StartWithOpts(register func(s *grpc.Server), opts []grpc.ServerOption) error {
-	g.server = grpc.NewServer(opts...)
+	if err := g.Bind(); err != nil {
+		log.Printf("Unable to bind gRPC server: %v", err)
+		g.finish(err)
+		return err
+	}
+	allOpts := append(append([]grpc.ServerOption{}, opts...), g.interceptorOpts()...)
+	allOpts = append(allOpts, limitOpts(g.config)...)
+	server := grpc.NewServer(allOpts...)
+	g.mutex.Lock()
+	g.server = server
+	g.mutex.Unlock()
+
+	register(server)
 
-	register(g.server)
+	g.registerMetrics(server)
+	g.registerHealth(server)
 
-	g.registerMetrics()
+	g.mutex.Lock()
+	httpHandler := g.httpHandler
+	g.mutex.Unlock()
+	if g.config.JSONGateway {
+		httpHandler = NewJSONGateway(server, httpHandler)
+	}
 
-	if err := g.server.Serve(g.listener); err != nil {
+	var err error
+	if httpHandler != nil {
+		err = g.serveHTTP(server, httpHandler)
+	} else {
+		err = server.Serve(newReadyListener(g.listener, g.ready))
+	}
+	if err != nil {
 		log.Printf("Unable to serve gRPC: %v", err)
+		g.finish(err)
 		return err
 	}
+	g.finish(nil)
 	return nil
 }
 
 func (g *grpcServer) Start(register func(s *grpc.Server)) error {
-	opts, err := GetServerOpts(g.config)
+	// Bind before loading the certificates so development certificates
+	// include the listen address.
+	if err := g.Bind(); err != nil {
+		log.Printf("Unable to bind gRPC server: %v", err)
+		g.finish(err)
+		return err
+	}
+	opts, err := g.ServerOpts()
 	if err != nil {
+		g.finish(err)
 		return err
 	}
 	return g.StartWithOpts(register, opts)
 }
 
-func (g *grpcServer) LaunchWithOpts(register func(s *grpc.Server), timeout time.Duration, opts []grpc.ServerOption) error {
-	errCh := make(chan error)
-
-	go func() {
-		if err := g.StartWithOpts(register, opts); err != nil {
-			errCh <- err
-		}
-	}()
+// finish records the terminal error, sets the health status to NOT_SERVING
+// and signals that the server is done. Only the first call has any effect.
+func (g *grpcServer) finish(err error) {
+	g.once.Do(func() {
+		g.mutex.Lock()
+		g.err = err
+		g.mutex.Unlock()
+		g.healthServer().Shutdown()
+		close(g.done)
+	})
+}
 
+// waitForReady waits until the server is serving, has failed or the timeout
+// expires.
+func (g *grpcServer) waitForReady(timeout time.Duration) error {
 	select {
-	case err := <-errCh:
-		return err
-	case <-time.After(timeout):
+	case <-g.ready:
 		return nil
+	case <-g.done:
+		if err := g.Err(); err != nil {
+			return err
+		}
+		return errors.New("gRPC server stopped before it was serving")
+	case <-time.After(timeout):
+		return errors.New("timed out waiting for gRPC server to start serving")
 	}
 }
 
+func (g *grpcServer) LaunchWithOpts(register func(s *grpc.Server), timeout time.Duration, opts []grpc.ServerOption) error {
+	go g.StartWithOpts(register, opts)
+	return g.waitForReady(timeout)
+}
+
 func (g *grpcServer) Launch(register func(s *grpc.Server), timeout time.Duration) error {
-	errCh := make(chan error)
+	go g.Start(register)
+	return g.waitForReady(timeout)
+}
 
-	go func() {
-		if err := g.Start(register); err != nil {
-			errCh <- err
-		}
-	}()
+func (g *grpcServer) Done() <-chan struct{} {
+	return g.done
+}
+
+func (g *grpcServer) Err() error {
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+	return g.err
+}
+
+func (g *grpcServer) Wait() error {
+	<-g.done
+	return g.Err()
+}
 
+// shutdown stops the background goroutines and returns the gRPC server and
+// the HTTP server. The gRPC server is nil if it hasn't been started and the
+// HTTP server is nil unless there's a HTTP handler.
+func (g *grpcServer) shutdown() (*grpc.Server, *http.Server, *httpMux) {
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
 	select {
-	case err := <-errCh:
+	case <-g.stop:
+	default:
+		close(g.stop)
+	}
+	return g.server, g.httpServer, g.mux
+}
+
+func (g *grpcServer) Stop() {
+	server, httpServer, _ := g.shutdown()
+	g.healthServer().Shutdown()
+	if server == nil {
+		g.stopUnstarted()
+		return
+	}
+	if httpServer != nil {
+		httpServer.Close()
+	}
+	server.Stop()
+}
+
+// stopUnstarted closes the listener for a server that hasn't been started
+func (g *grpcServer) stopUnstarted() {
+	g.mutex.Lock()
+	listener := g.listener
+	g.mutex.Unlock()
+	if listener != nil {
+		listener.Close()
+	}
+	g.finish(nil)
+}
+
+func (g *grpcServer) GracefulStop(ctx context.Context) error {
+	server, httpServer, mux := g.shutdown()
+
+	g.healthServer().Shutdown()
+	if g.config.DrainDelay > 0 {
+		select {
+		case <-time.After(g.config.DrainDelay):
+		case <-ctx.Done():
+		}
+	}
+
+	if server == nil {
+		g.stopUnstarted()
+		return nil
+	}
+	if httpServer != nil {
+		// Shutdown stops accepting connections, closes idle connections and
+		// waits for active requests. h2c connections are hijacked from the
+		// HTTP server so the mux waits for the requests on them.
+		err := httpServer.Shutdown(ctx)
+		if err == nil {
+			err = mux.drain(ctx)
+		}
+		if err != nil {
+			log.Printf("Graceful stop of gRPC server timed out, stopping: %v", err)
+			httpServer.Close()
+		}
+		server.Stop()
 		return err
-	case <-time.After(timeout):
+	}
+
+	stopped := make(chan struct{})
+	go func() {
+		server.GracefulStop()
+		close(stopped)
+	}()
+	select {
+	case <-stopped:
 		return nil
+	case <-ctx.Done():
+		log.Printf("Graceful stop of gRPC server timed out, stopping: %v", ctx.Err())
+		server.Stop()
+		<-stopped
+		return ctx.Err()
 	}
 }
 
-func (g *grpcServer) Stop() {
-	if g.server != nil {
-		g.server.Stop()
+func (g *grpcServer) healthServer() *health.Server {
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+	return g.health
+}
+
+func (g *grpcServer) SetHealthServer(healthServer *health.Server) {
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+	g.health = healthServer
+}
+
+func (g *grpcServer) SetServingStatus(service string, status grpc_health_v1.HealthCheckResponse_ServingStatus) {
+	g.healthServer().SetServingStatus(service, status)
+}
+
+func (g *grpcServer) Serving() bool {
+	select {
+	case <-g.done:
+		return false
+	case <-g.ready:
+	default:
+		return false
 	}
+	res, err := g.healthServer().Check(context.Background(), &grpc_health_v1.HealthCheckRequest{})
+	if err != nil {
+		return false
+	}
+	return res.Status == grpc_health_v1.HealthCheckResponse_SERVING
 }
 
 func (g *grpcServer) ListenAddress() net.Addr {
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+	if g.listener == nil {
+		return nil
+	}
 	return g.listener.Addr()
 }
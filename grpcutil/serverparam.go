@@ -15,12 +15,139 @@ package grpcutil
 //See the License for the specific language governing permissions and
 //limitations under the License.
 //
+import (
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+	"time"
+)
 
 // GRPCServerParam holds parameters for a GRPC server
 type GRPCServerParam struct {
-	Endpoint string `kong:"help='Service endpoint',default='localhost:0'"`
-	TLS      bool   `kong:"help='Enable TLS',default='false'"`
-	CertFile string `kong:"help='Certificate file',type='existingfile'"`
-	KeyFile  string `kong:"help='Certificate key file',type='existingfile'"`
-	Metrics  bool   `kong:"help='Add Prometheus interceptors for server',default='true'"`
+	Endpoint           string        `kong:"help='Service endpoint (host:port, unix:path or unix-abstract:name)',default='localhost:0'"`
+	SocketMode         string        `kong:"help='File mode for Unix domain sockets, ie 0660'"`
+	TLS                bool          `kong:"help='Enable TLS',default='false'"`
+	CertFile           string        `kong:"help='Certificate file',type='existingfile'"`
+	KeyFile            string        `kong:"help='Certificate key file',type='existingfile'"`
+	ClientCAFile       string        `kong:"help='CA certificate file for client certificates',type='existingfile'"`
+	RequireClientCert  bool          `kong:"help='Require and verify client certificates',default='false'"`
+	CertReloadInterval time.Duration `kong:"help='Interval for checking the certificate files for changes (0 disables)',default='0s'"`
+	DevCerts           bool          `kong:"help='Generate a development certificate when TLS is enabled without certificate files',default='false'"`
+	DevCAFile          string        `kong:"help='File the development CA certificate is written to (required with development certificates)'"`
+
+	KeepaliveTime                time.Duration `kong:"help='Ping clients after this much inactivity',default='2h'"`
+	KeepaliveTimeout             time.Duration `kong:"help='Close the connection if a ping is not acknowledged within this time',default='20s'"`
+	KeepaliveMinTime             time.Duration `kong:"help='Minimum time between client pings',default='5m'"`
+	KeepalivePermitWithoutStream bool          `kong:"help='Allow client pings when there are no active streams',default='false'"`
+	MaxConnectionIdle            time.Duration `kong:"help='Close connections that are idle for this long (0 disables)',default='0s'"`
+	MaxConnectionAge             time.Duration `kong:"help='Close connections older than this (0 disables)',default='0s'"`
+	MaxConnectionAgeGrace        time.Duration `kong:"help='Time for in-flight calls to complete after the maximum connection age (0 is forever)',default='0s'"`
+
+	Health     bool          `kong:"help='Register the gRPC health service',default='false'"`
+	DrainDelay time.Duration `kong:"help='Time to report NOT_SERVING before a graceful stop',default='0s'"`
+
+	JSONGateway bool `kong:"help='Serve unary methods as JSON over HTTP POST on the endpoint (gRPC is then served through the HTTP server without the keepalive settings and the maximum connection age)',default='false'"`
+
+	RecoverPanics bool `kong:"help='Turn panics in handlers and interceptors into Internal errors',default='false'"`
+
+	Metrics bool `kong:"help='Add Prometheus interceptors for server',default='true'"`
+
+	MaxConcurrentCalls int     `kong:"help='Maximum number of in-flight calls per method or peer (0 disables)',default='0'"`
+	RateLimit          float64 `kong:"help='Calls per second per method or peer (0 disables)',default='0'"`
+	RateBurst          int     `kong:"help='Calls allowed in a burst above the rate limit (0 is the rate rounded up)',default='0'"`
+	LimitPerPeer       bool    `kong:"help='Apply the limits per peer rather than per method',default='false'"`
+}
+
+// checkFile returns an error if the file can't be opened for reading
+func checkFile(name, description string) error {
+	f, err := os.Open(name)
+	if err != nil {
+		return fmt.Errorf("unable to read %s: %v", description, err)
+	}
+	f.Close()
+	return nil
+}
+
+// Validate checks the parameters and returns an error with every problem it
+// finds, including certificate files that can't be read and certificates
+// that don't match the key. The error is nil if there are no problems.
+func (p GRPCServerParam) Validate() error {
+	var errs []error
+	if _, _, err := parseEndpoint(p.Endpoint); err != nil {
+		errs = append(errs, fmt.Errorf("invalid endpoint: %v", err))
+	}
+	if p.SocketMode != "" {
+		if _, err := strconv.ParseUint(p.SocketMode, 8, 32); err != nil {
+			errs = append(errs, fmt.Errorf("invalid socket mode %s: %v", p.SocketMode, err))
+		}
+	}
+
+	if p.TLS {
+		errs = append(errs, p.validateCertificates()...)
+	} else if p.RequireClientCert || p.ClientCAFile != "" {
+		errs = append(errs, errors.New("client certificates require TLS"))
+	}
+
+	for _, d := range []struct {
+		name  string
+		value time.Duration
+	}{
+		{"certificate reload interval", p.CertReloadInterval},
+		{"keepalive time", p.KeepaliveTime},
+		{"keepalive timeout", p.KeepaliveTimeout},
+		{"keepalive minimum time", p.KeepaliveMinTime},
+		{"maximum connection idle", p.MaxConnectionIdle},
+		{"maximum connection age", p.MaxConnectionAge},
+		{"maximum connection age grace", p.MaxConnectionAgeGrace},
+		{"drain delay", p.DrainDelay},
+	} {
+		if d.value < 0 {
+			errs = append(errs, fmt.Errorf("%s can't be negative", d.name))
+		}
+	}
+	if p.MaxConcurrentCalls < 0 || p.RateLimit < 0 || p.RateBurst < 0 {
+		errs = append(errs, errors.New("limits can't be negative"))
+	}
+	if p.JSONGateway && p.MaxConnectionAge > 0 {
+		errs = append(errs, errors.New("the maximum connection age isn't supported with the JSON gateway"))
+	}
+	return errors.Join(errs...)
+}
+
+// validateCertificates checks the TLS certificate parameters
+func (p GRPCServerParam) validateCertificates() []error {
+	var errs []error
+	if p.DevCerts && p.CertFile == "" && p.KeyFile == "" {
+		if p.DevCAFile == "" {
+			errs = append(errs, errors.New("missing CA file for development certificates"))
+		}
+	} else {
+		if p.CertFile == "" {
+			errs = append(errs, errors.New("missing cert file for TLS"))
+		}
+		if p.KeyFile == "" {
+			errs = append(errs, errors.New("missing key file for TLS"))
+		}
+		if p.CertFile != "" && p.KeyFile != "" {
+			certErr := checkFile(p.CertFile, "cert file")
+			keyErr := checkFile(p.KeyFile, "key file")
+			errs = append(errs, certErr, keyErr)
+			if certErr == nil && keyErr == nil {
+				if _, err := tls.LoadX509KeyPair(p.CertFile, p.KeyFile); err != nil {
+					errs = append(errs, fmt.Errorf("invalid certificate and key in %s and %s: %v", p.CertFile, p.KeyFile, err))
+				}
+			}
+		}
+	}
+
+	if p.ClientCAFile != "" {
+		if _, err := loadCertPool(p.ClientCAFile); err != nil {
+			errs = append(errs, fmt.Errorf("invalid client CA file: %v", err))
+		}
+	} else if p.RequireClientCert {
+		errs = append(errs, errors.New("client CA file is required to verify client certificates"))
+	}
+	return errs
 }
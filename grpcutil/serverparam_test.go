@@ -0,0 +1,115 @@
+package grpcutil
+
+//
+//Copyright 2019 Telenor Digital AS
+//
+//Licensed under the Apache License, Version 2.0 (the "License");
+//you may not use this file except in compliance with the License.
+//You may obtain a copy of the License at
+//
+//http://www.apache.org/licenses/LICENSE-2.0
+//
+//Unless required by applicable law or agreed to in writing, software
+//distributed under the License is distributed on an "AS IS" BASIS,
+//WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//See the License for the specific language governing permissions and
+//limitations under the License.
+//
+import (
+	"crypto/x509"
+	"net"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc"
+)
+
+func TestValidate(t *testing.T) {
+	assert := require.New(t)
+
+	ca := newTestCA(t)
+	serverCert, serverKey := ca.Issue("server", x509.ExtKeyUsageServerAuth)
+	_, otherKey := ca.Issue("other", x509.ExtKeyUsageServerAuth)
+
+	assert.NoError(GRPCServerParam{Endpoint: "localhost:0"}.Validate())
+	assert.NoError(GRPCServerParam{Endpoint: "localhost:0", TLS: true, CertFile: serverCert, KeyFile: serverKey, ClientCAFile: ca.CAFile, RequireClientCert: true}.Validate())
+	assert.NoError(GRPCServerParam{Endpoint: "localhost:0", TLS: true, DevCerts: true, DevCAFile: "ca.crt"}.Validate())
+
+	// Every problem is reported
+	err := GRPCServerParam{
+		Endpoint:           "unix:",
+		SocketMode:         "rw",
+		TLS:                true,
+		CertFile:           filepath.Join(t.TempDir(), "missing.crt"),
+		KeyFile:            serverKey,
+		ClientCAFile:       serverKey,
+		DrainDelay:         -time.Second,
+		MaxConcurrentCalls: -1,
+	}.Validate()
+	assert.Error(err)
+	for _, problem := range []string{"invalid endpoint", "invalid socket mode", "unable to read cert file", "invalid client CA file", "drain delay", "limits"} {
+		assert.Contains(err.Error(), problem)
+	}
+
+	err = GRPCServerParam{Endpoint: "localhost:0", TLS: true, CertFile: serverCert, KeyFile: otherKey}.Validate()
+	assert.Error(err)
+	assert.Contains(err.Error(), "invalid certificate and key")
+
+	err = GRPCServerParam{Endpoint: "localhost:0", TLS: true, RequireClientCert: true}.Validate()
+	assert.Error(err)
+	for _, problem := range []string{"missing cert file", "missing key file", "client CA file is required"} {
+		assert.Contains(err.Error(), problem)
+	}
+
+	assert.Error(GRPCServerParam{Endpoint: "localhost:0", RequireClientCert: true}.Validate())
+
+	err = GRPCServerParam{Endpoint: "localhost:0", JSONGateway: true, MaxConnectionAge: time.Minute}.Validate()
+	assert.Error(err)
+	assert.Contains(err.Error(), "maximum connection age")
+}
+
+func TestUnboundServer(t *testing.T) {
+	assert := require.New(t)
+
+	port, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.NoError(err)
+	endpoint := port.Addr().String()
+	port.Close()
+
+	server, err := NewUnboundGRPCServer(GRPCServerParam{Endpoint: endpoint})
+	assert.NoError(err)
+	assert.Nil(server.ListenAddress())
+
+	// The port is free until the server is bound
+	listener, err := net.Listen("tcp", endpoint)
+	assert.NoError(err)
+	listener.Close()
+
+	assert.NoError(server.Bind())
+	assert.NoError(server.Bind())
+	assert.Equal(endpoint, server.ListenAddress().String())
+	assert.NoError(server.Launch(func(s *grpc.Server) {}, time.Second))
+	server.Stop()
+	assert.NoError(server.Wait())
+
+	// Servers are bound when they start
+	server, err = NewUnboundGRPCServer(GRPCServerParam{Endpoint: "127.0.0.1:0"})
+	assert.NoError(err)
+	assert.NoError(server.Launch(func(s *grpc.Server) {}, time.Second))
+	assert.NotNil(server.ListenAddress())
+	server.Stop()
+	assert.NoError(server.Wait())
+
+	// Bind errors are returned when the server starts
+	server, err = NewUnboundGRPCServer(GRPCServerParam{Endpoint: "unix:"})
+	assert.NoError(err)
+	assert.Error(server.Launch(func(s *grpc.Server) {}, time.Second))
+
+	// Stopped servers can't be bound
+	server, err = NewUnboundGRPCServer(GRPCServerParam{Endpoint: "127.0.0.1:0"})
+	assert.NoError(err)
+	server.Stop()
+	assert.Error(server.Bind())
+}
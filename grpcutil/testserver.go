@@ -0,0 +1,66 @@
+package grpcutil
+
+//
+//Copyright 2019 Telenor Digital AS
+//
+//Licensed under the Apache License, Version 2.0 (the "License");
+//you may not use this file except in compliance with the License.
+//You may obtain a copy of the License at
+//
+//http://www.apache.org/licenses/LICENSE-2.0
+//
+//Unless required by applicable law or agreed to in writing, software
+//distributed under the License is distributed on an "AS IS" BASIS,
+//WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//See the License for the specific language governing permissions and
+//limitations under the License.
+//
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/test/bufconn"
+)
+
+// testBufferSize is the buffer size for in-memory test connections
+const testBufferSize = 1024 * 1024
+
+// NewTestServer launches a server on an in-memory listener and returns the
+// server and a client connection to it. The server is configured from the
+// server parameters and the server options are added to the default set of
+// options. The client connection is configured from the client parameters
+// and the dial options; the server endpoint is ignored. Set the
+// ServerHostOverride parameter to match the server certificate when TLS is
+// enabled. The server and client connection are closed when the test
+// completes.
+func NewTestServer(t testing.TB, serverParams GRPCServerParam, clientParams GRPCClientParam, register func(s *grpc.Server), serverOpts []grpc.ServerOption, dialOpts ...grpc.DialOption) (GRPCServer, *grpc.ClientConn) {
+	t.Helper()
+
+	listener := bufconn.Listen(testBufferSize)
+	server, err := NewGRPCServerWithListener(serverParams, listener)
+	if err != nil {
+		t.Fatalf("Unable to create test server: %v", err)
+	}
+	opts, err := server.ServerOpts()
+	if err != nil {
+		t.Fatalf("Unable to get test server options: %v", err)
+	}
+	if err := server.LaunchWithOpts(register, time.Second, append(opts, serverOpts...)); err != nil {
+		t.Fatalf("Unable to launch test server: %v", err)
+	}
+	t.Cleanup(server.Stop)
+
+	clientParams.ServerEndpoint = "passthrough:///bufconn"
+	dialOpts = append(dialOpts, grpc.WithContextDialer(func(ctx context.Context, _ string) (net.Conn, error) {
+		return listener.DialContext(ctx)
+	}))
+	conn, err := NewGRPCClientConnection(clientParams, dialOpts...)
+	if err != nil {
+		t.Fatalf("Unable to create test client connection: %v", err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	return server, conn
+}
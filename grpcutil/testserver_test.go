@@ -0,0 +1,58 @@
+package grpcutil
+
+//
+//Copyright 2019 Telenor Digital AS
+//
+//Licensed under the Apache License, Version 2.0 (the "License");
+//you may not use this file except in compliance with the License.
+//You may obtain a copy of the License at
+//
+//http://www.apache.org/licenses/LICENSE-2.0
+//
+//Unless required by applicable law or agreed to in writing, software
+//distributed under the License is distributed on an "AS IS" BASIS,
+//WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//See the License for the specific language governing permissions and
+//limitations under the License.
+//
+import (
+	"context"
+	"crypto/x509"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/health/grpc_health_v1"
+)
+
+func TestTestServer(t *testing.T) {
+	assert := require.New(t)
+
+	server, conn := NewTestServer(t, GRPCServerParam{Health: true}, GRPCClientParam{}, func(s *grpc.Server) {}, nil)
+	assert.Equal("bufconn", server.ListenAddress().String())
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	res, err := grpc_health_v1.NewHealthClient(conn).Check(ctx, &grpc_health_v1.HealthCheckRequest{})
+	assert.NoError(err)
+	assert.Equal(grpc_health_v1.HealthCheckResponse_SERVING, res.Status)
+}
+
+func TestTestServerWithTLS(t *testing.T) {
+	assert := require.New(t)
+
+	ca := newTestCA(t)
+	serverCert, serverKey := ca.Issue("server", x509.ExtKeyUsageServerAuth)
+	clientCert, clientKey := ca.Issue("client", x509.ExtKeyUsageClientAuth)
+
+	_, conn := NewTestServer(t,
+		GRPCServerParam{TLS: true, CertFile: serverCert, KeyFile: serverKey, ClientCAFile: ca.CAFile, RequireClientCert: true, Health: true},
+		GRPCClientParam{TLS: true, CAFile: ca.CAFile, CertFile: clientCert, KeyFile: clientKey, ServerHostOverride: "localhost"},
+		func(s *grpc.Server) {}, nil)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	_, err := grpc_health_v1.NewHealthClient(conn).Check(ctx, &grpc_health_v1.HealthCheckRequest{})
+	assert.NoError(err)
+}
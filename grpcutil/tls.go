@@ -0,0 +1,177 @@
+package grpcutil
+
+//
+//Copyright 2019 Telenor Digital AS
+//
+//Licensed under the Apache License, Version 2.0 (the "License");
+//you may not use this file except in compliance with the License.
+//You may obtain a copy of the License at
+//
+//http://www.apache.org/licenses/LICENSE-2.0
+//
+//Unless required by applicable law or agreed to in writing, software
+//distributed under the License is distributed on an "AS IS" BASIS,
+//WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//See the License for the specific language governing permissions and
+//limitations under the License.
+//
+import (
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"strings"
+)
+
+// loadCertPool reads a PEM-encoded CA certificate file into a new pool
+func loadCertPool(caFile string) (*x509.CertPool, error) {
+	buf, err := os.ReadFile(caFile)
+	if err != nil {
+		return nil, err
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(buf) {
+		return nil, fmt.Errorf("no certificates found in %s", caFile)
+	}
+	return pool, nil
+}
+
+// loadServerCertificate loads the server certificate and key files. A
+// development certificate is generated for the listen address if the
+// DevCerts flag is set and there are no certificate files. The address is nil
+// if the listener isn't known.
+func loadServerCertificate(config GRPCServerParam, addr net.Addr) (*certReloader, error) {
+	if config.DevCerts && config.CertFile == "" && config.KeyFile == "" {
+		return devCertificate(config, addr)
+	}
+	if config.CertFile == "" || config.KeyFile == "" {
+		return nil, errors.New("missing cert file and key file parameters for GRPC server")
+	}
+	return newCertReloader(config.CertFile, config.KeyFile)
+}
+
+// serverTLSConfig builds the TLS configuration for a server. The server
+// certificate is served by the certificate reloader. Client certificates are
+// verified when a client CA file is set and required when the
+// RequireClientCert flag is set.
+func serverTLSConfig(config GRPCServerParam, certs *certReloader) (*tls.Config, error) {
+	ret := &tls.Config{
+		GetCertificate: certs.GetCertificate,
+	}
+	if config.ClientCAFile == "" {
+		if config.RequireClientCert {
+			return nil, errors.New("client CA file is required to verify client certificates")
+		}
+		return ret, nil
+	}
+	var err error
+	ret.ClientCAs, err = loadCertPool(config.ClientCAFile)
+	if err != nil {
+		return nil, err
+	}
+	ret.ClientAuth = tls.VerifyClientCertIfGiven
+	if config.RequireClientCert {
+		ret.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+	return ret, nil
+}
+
+// tlsVersions maps the MinTLSVersion parameter to TLS versions. Older
+// versions aren't supported.
+var tlsVersions = map[string]uint16{
+	"":    tls.VersionTLS12,
+	"1.2": tls.VersionTLS12,
+	"1.3": tls.VersionTLS13,
+}
+
+// clientCertPool returns the CA certificates for a client. The system
+// certificate pool is used when there's no CA file. Extra CA files are added
+// to the pool in both cases.
+func clientCertPool(config GRPCClientParam) (*x509.CertPool, error) {
+	var pool *x509.CertPool
+	var err error
+	if config.CAFile != "" {
+		pool, err = loadCertPool(config.CAFile)
+	} else {
+		pool, err = x509.SystemCertPool()
+	}
+	if err != nil {
+		return nil, err
+	}
+	for _, caFile := range config.ExtraCAFiles {
+		buf, err := os.ReadFile(caFile)
+		if err != nil {
+			return nil, err
+		}
+		if !pool.AppendCertsFromPEM(buf) {
+			return nil, fmt.Errorf("no certificates found in %s", caFile)
+		}
+	}
+	return pool, nil
+}
+
+// SPKIHash returns the base64-encoded SHA-256 hash of the certificate's
+// public key (SPKI). This is the format used for pinned keys.
+func SPKIHash(cert *x509.Certificate) string {
+	hash := sha256.Sum256(cert.RawSubjectPublicKeyInfo)
+	return base64.StdEncoding.EncodeToString(hash[:])
+}
+
+// verifyPinnedKeys returns a tls.Config.VerifyConnection callback that
+// accepts the connection if one of the certificates in the verified chains
+// has a pinned public key. Pins for the CA certificates will match every
+// certificate issued by the CA.
+func verifyPinnedKeys(pins []string) func(tls.ConnectionState) error {
+	pinned := make(map[string]bool)
+	for _, pin := range pins {
+		pinned[strings.TrimSpace(pin)] = true
+	}
+	return func(state tls.ConnectionState) error {
+		for _, chain := range state.VerifiedChains {
+			for _, cert := range chain {
+				if pinned[SPKIHash(cert)] {
+					return nil
+				}
+			}
+		}
+		return errors.New("no pinned public key found in the server's certificate chain")
+	}
+}
+
+// clientTLSConfig builds the TLS configuration for a client. The client
+// certificate is only presented when both the certificate and key files are
+// set.
+func clientTLSConfig(config GRPCClientParam) (*tls.Config, error) {
+	minVersion, ok := tlsVersions[config.MinTLSVersion]
+	if !ok {
+		return nil, fmt.Errorf("unsupported minimum TLS version: %s", config.MinTLSVersion)
+	}
+	pool, err := clientCertPool(config)
+	if err != nil {
+		return nil, err
+	}
+	ret := &tls.Config{
+		RootCAs:    pool,
+		ServerName: config.ServerHostOverride,
+		MinVersion: minVersion,
+	}
+	if len(config.PinnedKeys) > 0 {
+		ret.VerifyConnection = verifyPinnedKeys(config.PinnedKeys)
+	}
+	if config.CertFile == "" && config.KeyFile == "" {
+		return ret, nil
+	}
+	if config.CertFile == "" || config.KeyFile == "" {
+		return nil, errors.New("both cert file and key file must be set for client certificates")
+	}
+	cert, err := tls.LoadX509KeyPair(config.CertFile, config.KeyFile)
+	if err != nil {
+		return nil, err
+	}
+	ret.Certificates = []tls.Certificate{cert}
+	return ret, nil
+}
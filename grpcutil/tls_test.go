@@ -0,0 +1,205 @@
+package grpcutil
+
+//
+//Copyright 2019 Telenor Digital AS
+//
+//Licensed under the Apache License, Version 2.0 (the "License");
+//you may not use this file except in compliance with the License.
+//You may obtain a copy of the License at
+//
+//http://www.apache.org/licenses/LICENSE-2.0
+//
+//Unless required by applicable law or agreed to in writing, software
+//distributed under the License is distributed on an "AS IS" BASIS,
+//WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//See the License for the specific language governing permissions and
+//limitations under the License.
+//
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/health"
+	"google.golang.org/grpc/health/grpc_health_v1"
+)
+
+// testCA is a certificate authority used to issue test certificates
+type testCA struct {
+	t      *testing.T
+	dir    string
+	cert   *x509.Certificate
+	key    *ecdsa.PrivateKey
+	CAFile string
+}
+
+func newTestCA(t *testing.T) *testCA {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "Test CA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	require.NoError(t, err)
+	cert, err := x509.ParseCertificate(der)
+	require.NoError(t, err)
+
+	ret := &testCA{t: t, dir: t.TempDir(), cert: cert, key: key}
+	ret.CAFile = ret.writePEM("ca.crt", "CERTIFICATE", der)
+	return ret
+}
+
+func (c *testCA) writePEM(name, blockType string, der []byte) string {
+	fileName := filepath.Join(c.dir, name)
+	require.NoError(c.t, os.WriteFile(fileName, pem.EncodeToMemory(&pem.Block{Type: blockType, Bytes: der}), 0600))
+	return fileName
+}
+
+// Issue creates a new certificate and key signed by the CA and returns the
+// certificate and key file names.
+func (c *testCA) Issue(name string, usage x509.ExtKeyUsage) (string, string) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(c.t, err)
+	serial, err := rand.Int(rand.Reader, big.NewInt(1<<62))
+	require.NoError(c.t, err)
+	template := &x509.Certificate{
+		SerialNumber: serial,
+		Subject:      pkix.Name{CommonName: name},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{usage},
+		DNSNames:     []string{"localhost"},
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, c.cert, &key.PublicKey, c.key)
+	require.NoError(c.t, err)
+	keyDer, err := x509.MarshalPKCS8PrivateKey(key)
+	require.NoError(c.t, err)
+	return c.writePEM(name+".crt", "CERTIFICATE", der), c.writePEM(name+".key", "PRIVATE KEY", keyDer)
+}
+
+func TestMutualTLS(t *testing.T) {
+	assert := require.New(t)
+
+	ca := newTestCA(t)
+	serverCert, serverKey := ca.Issue("server", x509.ExtKeyUsageServerAuth)
+	clientCert, clientKey := ca.Issue("client", x509.ExtKeyUsageClientAuth)
+
+	serverConfig := GRPCServerParam{
+		Endpoint:          "127.0.0.1:0",
+		TLS:               true,
+		CertFile:          serverCert,
+		KeyFile:           serverKey,
+		ClientCAFile:      ca.CAFile,
+		RequireClientCert: true,
+	}
+	server, err := NewGRPCServer(serverConfig)
+	assert.NoError(err)
+
+	opts, err := GetServerOpts(serverConfig)
+	assert.NoError(err)
+
+	peerNames := make(chan string, 1)
+	opts = append(opts, grpc.UnaryInterceptor(func(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+		cert, ok := PeerCertificate(ctx)
+		assert.True(ok)
+		peerNames <- cert.Subject.CommonName
+		return handler(ctx, req)
+	}))
+	assert.NoError(server.LaunchWithOpts(func(s *grpc.Server) {
+		grpc_health_v1.RegisterHealthServer(s, health.NewServer())
+	}, 100*time.Millisecond, opts))
+	defer server.Stop()
+
+	clientConfig := GRPCClientParam{
+		ServerEndpoint:     server.ListenAddress().String(),
+		TLS:                true,
+		CAFile:             ca.CAFile,
+		ServerHostOverride: "localhost",
+		CertFile:           clientCert,
+		KeyFile:            clientKey,
+	}
+	conn, err := NewGRPCClientConnection(clientConfig)
+	assert.NoError(err)
+	defer conn.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	_, err = grpc_health_v1.NewHealthClient(conn).Check(ctx, &grpc_health_v1.HealthCheckRequest{})
+	assert.NoError(err)
+	assert.Equal("client", <-peerNames)
+
+	// Clients without a certificate are rejected
+	clientConfig.CertFile = ""
+	clientConfig.KeyFile = ""
+	noCertConn, err := NewGRPCClientConnection(clientConfig)
+	assert.NoError(err)
+	defer noCertConn.Close()
+	_, err = grpc_health_v1.NewHealthClient(noCertConn).Check(ctx, &grpc_health_v1.HealthCheckRequest{})
+	assert.Error(err)
+}
+
+func TestInvalidMutualTLSConfig(t *testing.T) {
+	assert := require.New(t)
+
+	ca := newTestCA(t)
+	serverCert, serverKey := ca.Issue("server", x509.ExtKeyUsageServerAuth)
+
+	_, err := GetServerOpts(GRPCServerParam{TLS: true, CertFile: serverCert, KeyFile: serverKey, RequireClientCert: true})
+	assert.Error(err, "Client CA is required when client certs are required")
+
+	_, err = GetDialOpts(GRPCClientParam{TLS: true, CAFile: ca.CAFile, CertFile: serverCert})
+	assert.Error(err, "Key file must be set with cert file")
+}
+
+func TestClientRootsAndPinning(t *testing.T) {
+	assert := require.New(t)
+
+	ca := newTestCA(t)
+	serverCert, serverKey := ca.Issue("server", x509.ExtKeyUsageServerAuth)
+	server, err := NewGRPCServer(GRPCServerParam{Endpoint: "127.0.0.1:0", TLS: true, CertFile: serverCert, KeyFile: serverKey, Health: true})
+	assert.NoError(err)
+	assert.NoError(server.Launch(func(s *grpc.Server) {}, time.Second))
+	defer server.Stop()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	check := func(config GRPCClientParam) error {
+		config.ServerEndpoint = server.ListenAddress().String()
+		config.TLS = true
+		conn, err := NewGRPCClientConnection(config)
+		assert.NoError(err)
+		defer conn.Close()
+		_, err = grpc_health_v1.NewHealthClient(conn).Check(ctx, &grpc_health_v1.HealthCheckRequest{})
+		return err
+	}
+
+	// The system roots don't include the test CA
+	assert.Error(check(GRPCClientParam{}))
+	assert.NoError(check(GRPCClientParam{ExtraCAFiles: []string{ca.CAFile}, MinTLSVersion: "1.3"}))
+
+	assert.NoError(check(GRPCClientParam{CAFile: ca.CAFile, PinnedKeys: []string{"invalid", SPKIHash(ca.cert)}}))
+	assert.Error(check(GRPCClientParam{CAFile: ca.CAFile, PinnedKeys: []string{"invalid"}}))
+
+	_, err = GetDialOpts(GRPCClientParam{TLS: true, ExtraCAFiles: []string{serverKey}})
+	assert.Error(err, "Extra CA files must contain certificates")
+}
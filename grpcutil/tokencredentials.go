@@ -0,0 +1,146 @@
+package grpcutil
+
+//
+//Copyright 2019 Telenor Digital AS
+//
+//Licensed under the Apache License, Version 2.0 (the "License");
+//you may not use this file except in compliance with the License.
+//You may obtain a copy of the License at
+//
+//http://www.apache.org/licenses/LICENSE-2.0
+//
+//Unless required by applicable law or agreed to in writing, software
+//distributed under the License is distributed on an "AS IS" BASIS,
+//WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//See the License for the specific language governing permissions and
+//limitations under the License.
+//
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"google.golang.org/grpc/credentials"
+)
+
+// tokenRereadInterval is the maximum time a token read from a file is used
+// before the file is read again. The file is also read again when the
+// modification time or size changes but writes within the timestamp
+// granularity of the file system can't be detected that way.
+const tokenRereadInterval = time.Second
+
+// tokenCredentials sends a bearer token with every call. If the token is read
+// from a file the file is read again when it changes.
+type tokenCredentials struct {
+	fileName   string
+	requireTLS bool
+	mutex      *sync.Mutex
+	token      string
+	modTime    time.Time
+	size       int64
+	readTime   time.Time
+}
+
+// NewTokenCredentials returns per-call credentials with a static bearer
+// token. Set requireTLS to refuse sending the token on insecure connections.
+func NewTokenCredentials(token string, requireTLS bool) credentials.PerRPCCredentials {
+	return &tokenCredentials{
+		requireTLS: requireTLS,
+		mutex:      &sync.Mutex{},
+		token:      token,
+	}
+}
+
+// NewTokenFileCredentials returns per-call credentials with a bearer token
+// read from a file. The file is read again when it is modified, and at least
+// once a second, so tokens can be rotated without reconnecting. Set
+// requireTLS to refuse sending the token on insecure connections.
+func NewTokenFileCredentials(fileName string, requireTLS bool) (credentials.PerRPCCredentials, error) {
+	ret := &tokenCredentials{
+		fileName:   fileName,
+		requireTLS: requireTLS,
+		mutex:      &sync.Mutex{},
+	}
+	if _, err := ret.currentToken(); err != nil {
+		return nil, err
+	}
+	return ret, nil
+}
+
+// currentToken returns the token, reading the token file if it has changed
+// or if it hasn't been read for a while. The previous token is used if the
+// file can't be read or is empty.
+func (t *tokenCredentials) currentToken() (string, error) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	if t.fileName == "" {
+		return t.token, nil
+	}
+	fi, err := os.Stat(t.fileName)
+	if err != nil {
+		if t.token != "" {
+			log.Printf("Unable to check token file %s, using previous token: %v", t.fileName, err)
+			return t.token, nil
+		}
+		return "", err
+	}
+	if t.token != "" && fi.ModTime().Equal(t.modTime) && fi.Size() == t.size && time.Since(t.readTime) < tokenRereadInterval {
+		return t.token, nil
+	}
+	buf, err := os.ReadFile(t.fileName)
+	if err != nil {
+		if t.token != "" {
+			log.Printf("Unable to read token file %s, using previous token: %v", t.fileName, err)
+			return t.token, nil
+		}
+		return "", err
+	}
+	changed := !fi.ModTime().Equal(t.modTime) || fi.Size() != t.size
+	t.modTime = fi.ModTime()
+	t.size = fi.Size()
+	t.readTime = time.Now()
+	token := strings.TrimSpace(string(buf))
+	if token == "" {
+		if t.token != "" {
+			if changed {
+				log.Printf("Token file %s is empty, using previous token", t.fileName)
+			}
+			return t.token, nil
+		}
+		return "", fmt.Errorf("token file %s is empty", t.fileName)
+	}
+	t.token = token
+	return t.token, nil
+}
+
+func (t *tokenCredentials) GetRequestMetadata(ctx context.Context, uri ...string) (map[string]string, error) {
+	token, err := t.currentToken()
+	if err != nil {
+		return nil, err
+	}
+	return map[string]string{"authorization": "Bearer " + token}, nil
+}
+
+func (t *tokenCredentials) RequireTransportSecurity() bool {
+	return t.requireTLS
+}
+
+// clientTokenCredentials returns the token credentials from the client
+// parameters or nil if no token is set.
+func clientTokenCredentials(config GRPCClientParam) (credentials.PerRPCCredentials, error) {
+	if config.Token != "" && config.TokenFile != "" {
+		return nil, errors.New("token and token file can't both be set")
+	}
+	if config.TokenFile != "" {
+		return NewTokenFileCredentials(config.TokenFile, config.TLS)
+	}
+	if config.Token != "" {
+		return NewTokenCredentials(config.Token, config.TLS), nil
+	}
+	return nil, nil
+}
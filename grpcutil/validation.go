@@ -0,0 +1,194 @@
+package grpcutil
+
+//
+//Copyright 2019 Telenor Digital AS
+//
+//Licensed under the Apache License, Version 2.0 (the "License");
+//you may not use this file except in compliance with the License.
+//You may obtain a copy of the License at
+//
+//http://www.apache.org/licenses/LICENSE-2.0
+//
+//Unless required by applicable law or agreed to in writing, software
+//distributed under the License is distributed on an "AS IS" BASIS,
+//WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//See the License for the specific language governing permissions and
+//limitations under the License.
+//
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// validator is implemented by messages that can validate themselves, ie
+// messages generated by protoc-gen-validate
+type validator interface {
+	Validate() error
+}
+
+// allValidator is implemented by protoc-gen-validate messages and returns
+// every violation rather than the first one
+type allValidator interface {
+	ValidateAll() error
+}
+
+// FieldError is a validation error for a single field. Return it (or
+// several of them joined with errors.Join) from Validate methods to get a
+// field violation for each field in the error details.
+type FieldError struct {
+	Field       string // Path to the field, ie address.street
+	Description string // Why the field is invalid
+}
+
+// NewFieldError creates a new validation error for a field
+func NewFieldError(field, format string, args ...interface{}) *FieldError {
+	return &FieldError{Field: field, Description: fmt.Sprintf(format, args...)}
+}
+
+func (f *FieldError) Error() string {
+	return f.Field + ": " + f.Description
+}
+
+// pgvFieldError is implemented by the errors from protoc-gen-validate. The
+// cause is set for fields with embedded messages that fail validation.
+type pgvFieldError interface {
+	Field() string
+	Reason() string
+	Cause() error
+}
+
+// joinFieldPath joins a field name to the path of the parent message
+func joinFieldPath(parent, field string) string {
+	if parent == "" {
+		return field
+	}
+	if field == "" {
+		return parent
+	}
+	return parent + "." + field
+}
+
+// fieldViolations converts validation errors to field violations. Joined
+// errors and the multi errors from protoc-gen-validate are expanded into one
+// violation per error. Wrapped field errors keep their field. The field and
+// reason are used for protoc-gen-validate errors and the causes of embedded
+// messages are expanded with the field path, ie address.street. Errors
+// without a field get an empty field name.
+func fieldViolations(err error) []*errdetails.BadRequest_FieldViolation {
+	return fieldViolationsWithPath("", err)
+}
+
+func fieldViolationsWithPath(path string, err error) []*errdetails.BadRequest_FieldViolation {
+	var inner []error
+	switch e := err.(type) {
+	case interface{ AllErrors() []error }:
+		inner = e.AllErrors()
+	case interface{ Unwrap() []error }:
+		inner = e.Unwrap()
+	}
+	if inner != nil {
+		var ret []*errdetails.BadRequest_FieldViolation
+		for _, e := range inner {
+			ret = append(ret, fieldViolationsWithPath(path, e)...)
+		}
+		return ret
+	}
+
+	var fieldErr *FieldError
+	if errors.As(err, &fieldErr) {
+		return []*errdetails.BadRequest_FieldViolation{{Field: joinFieldPath(path, fieldErr.Field), Description: fieldErr.Description}}
+	}
+	var pgvErr pgvFieldError
+	if errors.As(err, &pgvErr) {
+		field := joinFieldPath(path, pgvErr.Field())
+		if cause := pgvErr.Cause(); cause != nil {
+			return fieldViolationsWithPath(field, cause)
+		}
+		return []*errdetails.BadRequest_FieldViolation{{Field: field, Description: pgvErr.Reason()}}
+	}
+	return []*errdetails.BadRequest_FieldViolation{{Field: path, Description: err.Error()}}
+}
+
+// ValidationError converts a validation error to an InvalidArgument status
+// error with a google.rpc.BadRequest detail that holds the field violations.
+// Status errors are returned as is.
+func ValidationError(err error) error {
+	if _, ok := status.FromError(err); ok {
+		return err
+	}
+	s, detailErr := status.New(codes.InvalidArgument, err.Error()).WithDetails(&errdetails.BadRequest{
+		FieldViolations: fieldViolations(err),
+	})
+	if detailErr != nil {
+		log.Printf("Unable to add validation details: %v", detailErr)
+		return status.Error(codes.InvalidArgument, err.Error())
+	}
+	return s.Err()
+}
+
+// validateMessage validates the message if it implements ValidateAll or
+// Validate. Messages without validation methods are accepted.
+func validateMessage(msg interface{}) error {
+	var err error
+	switch v := msg.(type) {
+	case allValidator:
+		err = v.ValidateAll()
+	case validator:
+		err = v.Validate()
+	}
+	if err != nil {
+		return ValidationError(err)
+	}
+	return nil
+}
+
+// validatingStream validates the messages received on a stream
+type validatingStream struct {
+	grpc.ServerStream
+}
+
+func (v *validatingStream) RecvMsg(m interface{}) error {
+	if err := v.ServerStream.RecvMsg(m); err != nil {
+		return err
+	}
+	return validateMessage(m)
+}
+
+// ValidationInterceptor returns interceptors that validate incoming messages
+// that have a ValidateAll or Validate method, ie messages generated by
+// protoc-gen-validate. Invalid messages are rejected with InvalidArgument
+// and a google.rpc.BadRequest detail with the field violations. For streams
+// the error is returned from RecvMsg. Add it after the authentication
+// interceptor so unauthenticated clients don't get validation feedback.
+func ValidationInterceptor() ServerInterceptor {
+	return ServerInterceptor{
+		Unary: func(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+			if err := validateMessage(req); err != nil {
+				return nil, err
+			}
+			return handler(ctx, req)
+		},
+		Stream: func(srv interface{}, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+			return handler(srv, &validatingStream{ServerStream: ss})
+		},
+	}
+}
+
+// FieldViolations returns the field violations from an InvalidArgument
+// error. The boolean is false if the error doesn't have a
+// google.rpc.BadRequest detail.
+func FieldViolations(err error) ([]*errdetails.BadRequest_FieldViolation, bool) {
+	for _, detail := range status.Convert(err).Details() {
+		if br, ok := detail.(*errdetails.BadRequest); ok {
+			return br.GetFieldViolations(), true
+		}
+	}
+	return nil, false
+}
@@ -0,0 +1,195 @@
+package grpcutil
+
+//
+//Copyright 2019 Telenor Digital AS
+//
+//Licensed under the Apache License, Version 2.0 (the "License");
+//you may not use this file except in compliance with the License.
+//You may obtain a copy of the License at
+//
+//http://www.apache.org/licenses/LICENSE-2.0
+//
+//Unless required by applicable law or agreed to in writing, software
+//distributed under the License is distributed on an "AS IS" BASIS,
+//WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//See the License for the specific language governing permissions and
+//limitations under the License.
+//
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/health/grpc_health_v1"
+	"google.golang.org/grpc/status"
+)
+
+// validatedRequest is a health check request with validation. The service
+// name must be set and be in lower case.
+type validatedRequest struct {
+	*grpc_health_v1.HealthCheckRequest
+}
+
+func (v validatedRequest) Validate() error {
+	var errs []error
+	if v.Service == "" {
+		errs = append(errs, NewFieldError("service", "must be set"))
+	}
+	if strings.ToLower(v.Service) != v.Service {
+		errs = append(errs, NewFieldError("service", "must be lower case"))
+	}
+	if v.Service == "denied" {
+		return status.Error(codes.PermissionDenied, "denied")
+	}
+	return errors.Join(errs...)
+}
+
+// validatedServiceDesc has a unary method and a client stream that accept
+// validated requests
+var validatedServiceDesc = grpc.ServiceDesc{
+	ServiceName: "test.Validated",
+	HandlerType: (*interface{})(nil),
+	Methods: []grpc.MethodDesc{{
+		MethodName: "Check",
+		Handler: func(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+			req := validatedRequest{&grpc_health_v1.HealthCheckRequest{}}
+			if err := dec(req); err != nil {
+				return nil, err
+			}
+			handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+				return &grpc_health_v1.HealthCheckResponse{Status: grpc_health_v1.HealthCheckResponse_SERVING}, nil
+			}
+			return interceptor(ctx, req, &grpc.UnaryServerInfo{Server: srv, FullMethod: "/test.Validated/Check"}, handler)
+		},
+	}},
+	Streams: []grpc.StreamDesc{{
+		StreamName:    "Collect",
+		ClientStreams: true,
+		Handler: func(srv interface{}, stream grpc.ServerStream) error {
+			for {
+				if err := stream.RecvMsg(validatedRequest{&grpc_health_v1.HealthCheckRequest{}}); err != nil {
+					if err == io.EOF {
+						return stream.SendMsg(&grpc_health_v1.HealthCheckResponse{Status: grpc_health_v1.HealthCheckResponse_SERVING})
+					}
+					return err
+				}
+			}
+		},
+	}},
+}
+
+func TestValidationInterceptor(t *testing.T) {
+	assert := require.New(t)
+
+	serverOpts := chainInterceptors([]ServerInterceptor{ValidationInterceptor()})
+	_, conn := NewTestServer(t, GRPCServerParam{}, GRPCClientParam{}, func(s *grpc.Server) {
+		s.RegisterService(&validatedServiceDesc, struct{}{})
+	}, serverOpts)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	check := func(service string) error {
+		return conn.Invoke(ctx, "/test.Validated/Check", &grpc_health_v1.HealthCheckRequest{Service: service}, &grpc_health_v1.HealthCheckResponse{})
+	}
+	assert.NoError(check("valid"))
+
+	err := check("")
+	assert.Equal(codes.InvalidArgument, status.Code(err))
+	violations, ok := FieldViolations(err)
+	assert.True(ok)
+	assert.Len(violations, 1)
+	assert.Equal("service", violations[0].Field)
+	assert.Equal("must be set", violations[0].Description)
+
+	// Status errors from Validate are returned as is
+	assert.Equal(codes.PermissionDenied, status.Code(check("denied")))
+
+	// Streamed messages are validated too
+	stream, err := conn.NewStream(ctx, &validatedServiceDesc.Streams[0], "/test.Validated/Collect")
+	assert.NoError(err)
+	assert.NoError(stream.SendMsg(&grpc_health_v1.HealthCheckRequest{Service: "valid"}))
+	assert.NoError(stream.SendMsg(&grpc_health_v1.HealthCheckRequest{Service: "Invalid"}))
+	assert.NoError(stream.CloseSend())
+	err = stream.RecvMsg(&grpc_health_v1.HealthCheckResponse{})
+	assert.Equal(codes.InvalidArgument, status.Code(err))
+	violations, ok = FieldViolations(err)
+	assert.True(ok)
+	assert.Equal("must be lower case", violations[0].Description)
+
+	_, ok = FieldViolations(errors.New("not a status"))
+	assert.False(ok)
+}
+
+// pgvError and pgvMultiError mimic the errors from protoc-gen-validate
+type pgvError struct {
+	field, reason string
+	cause         error
+}
+
+func (p pgvError) Field() string  { return p.field }
+func (p pgvError) Reason() string { return p.reason }
+func (p pgvError) Cause() error   { return p.cause }
+func (p pgvError) Error() string  { return p.field + ": " + p.reason }
+
+type pgvMultiError []error
+
+func (p pgvMultiError) AllErrors() []error { return p }
+func (p pgvMultiError) Error() string      { return "multiple errors" }
+
+func TestValidationError(t *testing.T) {
+	assert := require.New(t)
+
+	err := ValidationError(pgvMultiError{pgvError{field: "name", reason: "too short"}, pgvError{field: "age", reason: "must be positive"}, errors.New("other")})
+	assert.Equal(codes.InvalidArgument, status.Code(err))
+	violations, ok := FieldViolations(err)
+	assert.True(ok)
+	assert.Len(violations, 3)
+	assert.Equal("name", violations[0].Field)
+	assert.Equal("too short", violations[0].Description)
+	assert.Equal("age", violations[1].Field)
+	assert.Equal("", violations[2].Field)
+	assert.Equal("other", violations[2].Description)
+}
+
+func TestNestedFieldViolations(t *testing.T) {
+	assert := require.New(t)
+
+	// Embedded messages are expanded with the field path
+	err := ValidationError(pgvMultiError{
+		pgvError{field: "address", reason: "embedded message failed validation", cause: pgvMultiError{
+			pgvError{field: "street", reason: "must be set"},
+			pgvError{field: "location", reason: "embedded message failed validation", cause: pgvError{field: "lat", reason: "out of range"}},
+		}},
+		pgvError{field: "owner", reason: "embedded message failed validation", cause: errors.New("invalid")},
+	})
+	violations, ok := FieldViolations(err)
+	assert.True(ok)
+	assert.Len(violations, 3)
+	assert.Equal("address.street", violations[0].Field)
+	assert.Equal("must be set", violations[0].Description)
+	assert.Equal("address.location.lat", violations[1].Field)
+	assert.Equal("out of range", violations[1].Description)
+	assert.Equal("owner", violations[2].Field)
+	assert.Equal("invalid", violations[2].Description)
+
+	// Wrapped field errors keep their field
+	err = ValidationError(errors.Join(
+		fmt.Errorf("invalid request: %w", NewFieldError("service", "must be set")),
+		fmt.Errorf("invalid address: %w", pgvError{field: "street", reason: "too long"}),
+	))
+	violations, ok = FieldViolations(err)
+	assert.True(ok)
+	assert.Len(violations, 2)
+	assert.Equal("service", violations[0].Field)
+	assert.Equal("must be set", violations[0].Description)
+	assert.Equal("street", violations[1].Field)
+	assert.Equal("too long", violations[1].Description)
+}
@@ -0,0 +1,409 @@
+package metrics
+
+//
+//Copyright 2019 Telenor Digital AS
+//
+//Licensed under the Apache License, Version 2.0 (the "License");
+//you may not use this file except in compliance with the License.
+//You may obtain a copy of the License at
+//
+//http://www.apache.org/licenses/LICENSE-2.0
+//
+//Unless required by applicable law or agreed to in writing, software
+//distributed under the License is distributed on an "AS IS" BASIS,
+//WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//See the License for the specific language governing permissions and
+//limitations under the License.
+//
+import (
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"html/template"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"google.golang.org/grpc"
+	channelzpb "google.golang.org/grpc/channelz/grpc_channelz_v1"
+	"google.golang.org/grpc/channelz/service"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+// maxChannelzSockets is the maximum number of sockets listed per server
+const maxChannelzSockets = 100
+
+// channelzRegistrar captures the channelz service implementation so it can
+// be called directly by the HTML and JSON views
+type channelzRegistrar struct {
+	server channelzpb.ChannelzServer
+}
+
+func (c *channelzRegistrar) RegisterService(desc *grpc.ServiceDesc, impl interface{}) {
+	c.server = impl.(channelzpb.ChannelzServer)
+}
+
+// newChannelzService returns the channelz service. Channelz is turned on when
+// the service package is imported so gRPC servers and channels created
+// before the monitoring server are included.
+func newChannelzService() channelzpb.ChannelzServer {
+	r := &channelzRegistrar{}
+	service.RegisterChannelzServiceToServer(r)
+	return r.server
+}
+
+type socketView struct {
+	ID               int64     `json:"id"`
+	Local            string    `json:"local"`
+	Remote           string    `json:"remote"`
+	StreamsStarted   int64     `json:"streamsStarted"`
+	StreamsSucceeded int64     `json:"streamsSucceeded"`
+	StreamsFailed    int64     `json:"streamsFailed"`
+	MessagesSent     int64     `json:"messagesSent"`
+	MessagesReceived int64     `json:"messagesReceived"`
+	LastMessageSent  time.Time `json:"lastMessageSent"`
+}
+
+type callsView struct {
+	CallsStarted   int64     `json:"callsStarted"`
+	CallsSucceeded int64     `json:"callsSucceeded"`
+	CallsFailed    int64     `json:"callsFailed"`
+	LastCall       time.Time `json:"lastCall"`
+}
+
+type serverView struct {
+	ID            int64        `json:"id"`
+	Name          string       `json:"name"`
+	ListenSockets []string     `json:"listenSockets"`
+	Sockets       []socketView `json:"sockets"`
+	callsView
+}
+
+type subchannelView struct {
+	ID      int64        `json:"id"`
+	Target  string       `json:"target"`
+	State   string       `json:"state"`
+	Sockets []socketView `json:"sockets"`
+	callsView
+}
+
+type channelView struct {
+	ID          int64            `json:"id"`
+	Target      string           `json:"target"`
+	State       string           `json:"state"`
+	Subchannels []subchannelView `json:"subchannels"`
+	callsView
+}
+
+type channelzView struct {
+	Servers  []serverView  `json:"servers"`
+	Channels []channelView `json:"channels"`
+}
+
+func timestamp(ts *timestamppb.Timestamp) time.Time {
+	if ts == nil {
+		return time.Time{}
+	}
+	return ts.AsTime()
+}
+
+// formatAddress formats a channelz address as host:port or a socket path
+func formatAddress(addr *channelzpb.Address) string {
+	switch {
+	case addr.GetTcpipAddress() != nil:
+		tcp := addr.GetTcpipAddress()
+		return net.JoinHostPort(net.IP(tcp.GetIpAddress()).String(), fmt.Sprint(tcp.GetPort()))
+	case addr.GetUdsAddress() != nil:
+		return "unix:" + addr.GetUdsAddress().GetFilename()
+	case addr.GetOtherAddress() != nil:
+		return addr.GetOtherAddress().GetName()
+	default:
+		return ""
+	}
+}
+
+// channelzCollector builds the view from the channelz service
+type channelzCollector struct {
+	ctx context.Context
+	cz  channelzpb.ChannelzServer
+}
+
+func (c *channelzCollector) sockets(refs []*channelzpb.SocketRef) []socketView {
+	ret := make([]socketView, 0)
+	for _, ref := range refs {
+		res, err := c.cz.GetSocket(c.ctx, &channelzpb.GetSocketRequest{SocketId: ref.GetSocketId()})
+		if err != nil {
+			// The socket is closed
+			continue
+		}
+		data := res.GetSocket().GetData()
+		ret = append(ret, socketView{
+			ID:               ref.GetSocketId(),
+			Local:            formatAddress(res.GetSocket().GetLocal()),
+			Remote:           formatAddress(res.GetSocket().GetRemote()),
+			StreamsStarted:   data.GetStreamsStarted(),
+			StreamsSucceeded: data.GetStreamsSucceeded(),
+			StreamsFailed:    data.GetStreamsFailed(),
+			MessagesSent:     data.GetMessagesSent(),
+			MessagesReceived: data.GetMessagesReceived(),
+			LastMessageSent:  timestamp(data.GetLastMessageSentTimestamp()),
+		})
+	}
+	return ret
+}
+
+func (c *channelzCollector) servers() ([]serverView, error) {
+	ret := make([]serverView, 0)
+	start := int64(0)
+	for {
+		res, err := c.cz.GetServers(c.ctx, &channelzpb.GetServersRequest{StartServerId: start})
+		if err != nil {
+			return nil, err
+		}
+		for _, server := range res.GetServer() {
+			id := server.GetRef().GetServerId()
+			start = id + 1
+			data := server.GetData()
+			view := serverView{
+				ID:            id,
+				Name:          server.GetRef().GetName(),
+				ListenSockets: make([]string, 0),
+				callsView: callsView{
+					CallsStarted:   data.GetCallsStarted(),
+					CallsSucceeded: data.GetCallsSucceeded(),
+					CallsFailed:    data.GetCallsFailed(),
+					LastCall:       timestamp(data.GetLastCallStartedTimestamp()),
+				},
+			}
+			for _, ref := range server.GetListenSocket() {
+				view.ListenSockets = append(view.ListenSockets, ref.GetName())
+			}
+			sockets, err := c.cz.GetServerSockets(c.ctx, &channelzpb.GetServerSocketsRequest{ServerId: id, MaxResults: maxChannelzSockets})
+			if err != nil {
+				return nil, err
+			}
+			view.Sockets = c.sockets(sockets.GetSocketRef())
+			ret = append(ret, view)
+		}
+		if res.GetEnd() || len(res.GetServer()) == 0 {
+			return ret, nil
+		}
+	}
+}
+
+func (c *channelzCollector) subchannels(refs []*channelzpb.SubchannelRef) []subchannelView {
+	ret := make([]subchannelView, 0)
+	for _, ref := range refs {
+		res, err := c.cz.GetSubchannel(c.ctx, &channelzpb.GetSubchannelRequest{SubchannelId: ref.GetSubchannelId()})
+		if err != nil {
+			continue
+		}
+		data := res.GetSubchannel().GetData()
+		ret = append(ret, subchannelView{
+			ID:      ref.GetSubchannelId(),
+			Target:  data.GetTarget(),
+			State:   data.GetState().GetState().String(),
+			Sockets: c.sockets(res.GetSubchannel().GetSocketRef()),
+			callsView: callsView{
+				CallsStarted:   data.GetCallsStarted(),
+				CallsSucceeded: data.GetCallsSucceeded(),
+				CallsFailed:    data.GetCallsFailed(),
+				LastCall:       timestamp(data.GetLastCallStartedTimestamp()),
+			},
+		})
+	}
+	return ret
+}
+
+func (c *channelzCollector) channels() ([]channelView, error) {
+	ret := make([]channelView, 0)
+	start := int64(0)
+	for {
+		res, err := c.cz.GetTopChannels(c.ctx, &channelzpb.GetTopChannelsRequest{StartChannelId: start})
+		if err != nil {
+			return nil, err
+		}
+		for _, channel := range res.GetChannel() {
+			id := channel.GetRef().GetChannelId()
+			start = id + 1
+			data := channel.GetData()
+			ret = append(ret, channelView{
+				ID:          id,
+				Target:      data.GetTarget(),
+				State:       data.GetState().GetState().String(),
+				Subchannels: c.subchannels(channel.GetSubchannelRef()),
+				callsView: callsView{
+					CallsStarted:   data.GetCallsStarted(),
+					CallsSucceeded: data.GetCallsSucceeded(),
+					CallsFailed:    data.GetCallsFailed(),
+					LastCall:       timestamp(data.GetLastCallStartedTimestamp()),
+				},
+			})
+		}
+		if res.GetEnd() || len(res.GetChannel()) == 0 {
+			return ret, nil
+		}
+	}
+}
+
+func (c *channelzCollector) collect() (channelzView, error) {
+	var err error
+	ret := channelzView{}
+	if ret.Servers, err = c.servers(); err != nil {
+		return ret, err
+	}
+	if ret.Channels, err = c.channels(); err != nil {
+		return ret, err
+	}
+	return ret, nil
+}
+
+var channelzTemplate = template.Must(template.New("channelz").Parse(`
+<html>
+	<head><title>Channelz</title></head>
+	<body>
+		<p><a href="/channelz/json">JSON</a></p>
+		<h2>Servers</h2>
+		<table border="1">
+			<tr><th>ID</th><th>Name</th><th>Listen sockets</th><th>Calls started</th><th>Succeeded</th><th>Failed</th><th>Last call</th></tr>
+			{{range .Servers}}
+			<tr><td>{{.ID}}</td><td>{{.Name}}</td><td>{{range .ListenSockets}}{{.}} {{end}}</td><td>{{.CallsStarted}}</td><td>{{.CallsSucceeded}}</td><td>{{.CallsFailed}}</td><td>{{.LastCall.Format "2006-01-02 15:04:05"}}</td></tr>
+			{{if .Sockets}}
+			<tr><td></td><td colspan="6">{{template "sockets" .Sockets}}</td></tr>
+			{{end}}
+			{{end}}
+		</table>
+		<h2>Channels</h2>
+		<table border="1">
+			<tr><th>ID</th><th>Target</th><th>State</th><th>Calls started</th><th>Succeeded</th><th>Failed</th><th>Last call</th></tr>
+			{{range .Channels}}
+			<tr><td>{{.ID}}</td><td>{{.Target}}</td><td>{{.State}}</td><td>{{.CallsStarted}}</td><td>{{.CallsSucceeded}}</td><td>{{.CallsFailed}}</td><td>{{.LastCall.Format "2006-01-02 15:04:05"}}</td></tr>
+			{{range .Subchannels}}
+			<tr><td></td><td colspan="6">Subchannel {{.ID}} {{.Target}} {{.State}}: {{.CallsStarted}} started, {{.CallsSucceeded}} succeeded, {{.CallsFailed}} failed
+			{{if .Sockets}}{{template "sockets" .Sockets}}{{end}}</td></tr>
+			{{end}}
+			{{end}}
+		</table>
+	</body>
+</html>
+{{define "sockets"}}
+<table>
+	<tr><th>Socket</th><th>Local</th><th>Remote</th><th>Streams started</th><th>Succeeded</th><th>Failed</th><th>Messages sent</th><th>Received</th></tr>
+	{{range .}}
+	<tr><td>{{.ID}}</td><td>{{.Local}}</td><td>{{.Remote}}</td><td>{{.StreamsStarted}}</td><td>{{.StreamsSucceeded}}</td><td>{{.StreamsFailed}}</td><td>{{.MessagesSent}}</td><td>{{.MessagesReceived}}</td></tr>
+	{{end}}
+</table>
+{{end}}
+`))
+
+// channelzHandler serves the channelz data as HTML on /channelz/ and as JSON
+// on /channelz/json.
+func channelzHandler(cz channelzpb.ChannelzServer) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		collector := &channelzCollector{ctx: r.Context(), cz: cz}
+		view, err := collector.collect()
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		if strings.TrimSuffix(r.URL.Path, "/") == "/channelz/json" {
+			w.Header().Set("Content-Type", "application/json")
+			enc := json.NewEncoder(w)
+			enc.SetIndent("", "  ")
+			if err := enc.Encode(&view); err != nil {
+				log.Printf("Unable to write channelz JSON: %v", err)
+			}
+			return
+		}
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		if err := channelzTemplate.Execute(w, &view); err != nil {
+			log.Printf("Unable to write channelz page: %v", err)
+		}
+	}
+}
+
+// maxChannelzRequestSize is the maximum size of a channelz request message
+const maxChannelzRequestSize = 1 << 20
+
+// channelzGRPCHandler serves the channelz service as gRPC. A grpc.Server
+// isn't used since it would be registered in channelz and show up next to
+// the servers in the process. The channelz methods are all unary so only
+// unary calls with uncompressed messages are supported.
+func channelzGRPCHandler(cz channelzpb.ChannelzServer) http.HandlerFunc {
+	methods := make(map[string]grpc.MethodDesc)
+	for _, method := range channelzpb.Channelz_ServiceDesc.Methods {
+		methods["/"+channelzpb.Channelz_ServiceDesc.ServiceName+"/"+method.MethodName] = method
+	}
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/grpc")
+		reply, err := channelzCall(cz, methods, r)
+		if err == nil {
+			if err = writeGRPCMessage(w, reply); err != nil {
+				log.Printf("Unable to write channelz response: %v", err)
+				return
+			}
+		}
+		st := status.Convert(err)
+		w.Header().Set(http.TrailerPrefix+"Grpc-Status", strconv.Itoa(int(st.Code())))
+		if st.Message() != "" {
+			w.Header().Set(http.TrailerPrefix+"Grpc-Message", url.PathEscape(st.Message()))
+		}
+	}
+}
+
+// channelzCall reads the request message and calls the channelz method
+func channelzCall(cz channelzpb.ChannelzServer, methods map[string]grpc.MethodDesc, r *http.Request) (interface{}, error) {
+	method, ok := methods[r.URL.Path]
+	if !ok {
+		return nil, status.Errorf(codes.Unimplemented, "unknown method %s", r.URL.Path)
+	}
+	if encoding := r.Header.Get("Grpc-Encoding"); encoding != "" && encoding != "identity" {
+		return nil, status.Errorf(codes.Unimplemented, "compression with %s isn't supported", encoding)
+	}
+	prefix := make([]byte, 5)
+	if _, err := io.ReadFull(r.Body, prefix); err != nil {
+		return nil, status.Errorf(codes.Internal, "unable to read request: %v", err)
+	}
+	if prefix[0] != 0 {
+		return nil, status.Error(codes.Unimplemented, "compressed messages aren't supported")
+	}
+	size := binary.BigEndian.Uint32(prefix[1:])
+	if size > maxChannelzRequestSize {
+		return nil, status.Errorf(codes.ResourceExhausted, "request is %d bytes", size)
+	}
+	buf := make([]byte, size)
+	if _, err := io.ReadFull(r.Body, buf); err != nil {
+		return nil, status.Errorf(codes.Internal, "unable to read request: %v", err)
+	}
+	dec := func(req interface{}) error {
+		if err := proto.Unmarshal(buf, req.(proto.Message)); err != nil {
+			return status.Errorf(codes.Internal, "unable to unmarshal request: %v", err)
+		}
+		return nil
+	}
+	return method.Handler(cz, r.Context(), dec, nil)
+}
+
+// writeGRPCMessage writes a length-prefixed message
+func writeGRPCMessage(w http.ResponseWriter, msg interface{}) error {
+	buf, err := proto.Marshal(msg.(proto.Message))
+	if err != nil {
+		return err
+	}
+	prefix := make([]byte, 5)
+	binary.BigEndian.PutUint32(prefix[1:], uint32(len(buf)))
+	if _, err := w.Write(prefix); err != nil {
+		return err
+	}
+	_, err = w.Write(buf)
+	return err
+}
@@ -0,0 +1,118 @@
+package metrics_test
+
+//
+//Copyright 2019 Telenor Digital AS
+//
+//Licensed under the Apache License, Version 2.0 (the "License");
+//you may not use this file except in compliance with the License.
+//You may obtain a copy of the License at
+//
+//http://www.apache.org/licenses/LICENSE-2.0
+//
+//Unless required by applicable law or agreed to in writing, software
+//distributed under the License is distributed on an "AS IS" BASIS,
+//WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//See the License for the specific language governing permissions and
+//limitations under the License.
+//
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/lab5e/gotoolbox/grpcutil"
+	"github.com/lab5e/gotoolbox/metrics"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc"
+	channelzpb "google.golang.org/grpc/channelz/grpc_channelz_v1"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/health/grpc_health_v1"
+	"google.golang.org/grpc/status"
+)
+
+func TestChannelzOnMonitoringServer(t *testing.T) {
+	assert := require.New(t)
+
+	server, err := grpcutil.NewGRPCServer(grpcutil.GRPCServerParam{Endpoint: "127.0.0.1:0", Health: true})
+	assert.NoError(err)
+	assert.NoError(server.Launch(func(s *grpc.Server) {}, time.Second))
+	defer server.Stop()
+
+	conn, err := grpcutil.NewGRPCClientConnection(grpcutil.GRPCClientParam{ServerEndpoint: server.ListenAddress().String()})
+	assert.NoError(err)
+	defer conn.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	_, err = grpc_health_v1.NewHealthClient(conn).Check(ctx, &grpc_health_v1.HealthCheckRequest{})
+	assert.NoError(err)
+
+	mon, err := metrics.NewMonitoringServer("127.0.0.1:0")
+	assert.NoError(err)
+	assert.NoError(mon.Start())
+	defer mon.Shutdown()
+
+	get := func(path string) string {
+		res, err := http.Get(mon.ServerURL() + path)
+		assert.NoError(err)
+		defer res.Body.Close()
+		assert.Equal(http.StatusOK, res.StatusCode)
+		buf, err := io.ReadAll(res.Body)
+		assert.NoError(err)
+		return string(buf)
+	}
+	assert.Contains(get("/"), `href="/channelz/"`)
+	assert.Contains(get("/channelz/"), server.ListenAddress().String())
+
+	var view struct {
+		Servers []struct {
+			ListenSockets []string `json:"listenSockets"`
+			CallsStarted  int64    `json:"callsStarted"`
+			Sockets       []struct {
+				MessagesReceived int64 `json:"messagesReceived"`
+			} `json:"sockets"`
+		} `json:"servers"`
+		Channels []struct {
+			Target         string `json:"target"`
+			State          string `json:"state"`
+			CallsSucceeded int64  `json:"callsSucceeded"`
+		} `json:"channels"`
+	}
+	assert.NoError(json.Unmarshal([]byte(get("/channelz/json")), &view))
+	found := false
+	for _, s := range view.Servers {
+		if strings.Contains(strings.Join(s.ListenSockets, " "), server.ListenAddress().String()) {
+			found = true
+			assert.Equal(int64(1), s.CallsStarted)
+			assert.Len(s.Sockets, 1)
+			assert.Equal(int64(1), s.Sockets[0].MessagesReceived)
+		}
+	}
+	assert.True(found)
+	found = false
+	for _, c := range view.Channels {
+		if c.Target == server.ListenAddress().String() {
+			found = true
+			assert.Equal("READY", c.State)
+			assert.Equal(int64(1), c.CallsSucceeded)
+		}
+	}
+	assert.True(found)
+
+	// The channelz service is served on the same endpoint
+	monConn, err := grpcutil.NewGRPCClientConnection(grpcutil.GRPCClientParam{ServerEndpoint: mon.ListenAddress().String()})
+	assert.NoError(err)
+	defer monConn.Close()
+	res, err := channelzpb.NewChannelzClient(monConn).GetServers(ctx, &channelzpb.GetServersRequest{})
+	assert.NoError(err)
+	assert.NotEmpty(res.GetServer())
+	_, err = channelzpb.NewChannelzClient(monConn).GetServer(ctx, &channelzpb.GetServerRequest{ServerId: -1})
+	assert.Equal(codes.NotFound, status.Code(err))
+
+	// The channelz service doesn't add a gRPC server of its own
+	assert.NoError(json.Unmarshal([]byte(get("/channelz/json")), &view))
+	assert.Len(view.Servers, len(res.GetServer()))
+}
@@ -23,24 +23,32 @@ import (
 	"net/http/pprof"
 	"sync/atomic"
 
+	"github.com/lab5e/gotoolbox/rest"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"golang.org/x/net/http2"
+	"golang.org/x/net/http2/h2c"
 )
 
 // Server is the monitoring endpoint. The monitoring endpoint provides
 // counters for the service and a resource to do live traces of a running
 // service. Overall performance is affected by the trace so use with caution
-// on running systems under load.
+// on running systems under load. The gRPC channelz service is served on the
+// same endpoint (with HTTP/2 without TLS) and the channelz data is available
+// as HTML and JSON under /channelz/.
 type Server struct {
 	Listener     net.Listener
 	mux          *http.ServeMux
+	channelz     http.Handler
 	srv          *http.Server
 	healthStatus *int32
+	healthCheck  *atomic.Value
 }
 
 // NewMonitoringServer creates a new monitoring endpoint
 func NewMonitoringServer(endpoint string) (*Server, error) {
 	ret := &Server{
 		healthStatus: new(int32),
+		healthCheck:  &atomic.Value{},
 	}
 	ret.SetStatus(http.StatusServiceUnavailable)
 	var err error
@@ -64,6 +72,7 @@ func NewMonitoringServer(endpoint string) (*Server, error) {
 				<ul>
 					<li><a href="/pprof/">Profiling</a></li>
 					<li><a href="/metrics">Metrics</a></li>
+					<li><a href="/channelz/">gRPC channels</a></li>
 					<li><button onClick="startTrace()">Trace for 2s</button></li>
 				</ul>
 			</html>
@@ -80,6 +89,10 @@ func NewMonitoringServer(endpoint string) (*Server, error) {
 	enableTracingRoutine()
 	ret.mux.HandleFunc("/trace", traceHandler())
 	ret.mux.HandleFunc("/healthz", ret.healthzHandler)
+
+	cz := newChannelzService()
+	ret.channelz = channelzGRPCHandler(cz)
+	ret.mux.HandleFunc("/channelz/", channelzHandler(cz))
 	ret.srv = &http.Server{}
 	return ret, nil
 }
@@ -87,7 +100,7 @@ func NewMonitoringServer(endpoint string) (*Server, error) {
 // Start launches the server
 func (s *Server) Start() error {
 	go func() {
-		if err := http.Serve(s.Listener, s.mux); err != http.ErrServerClosed {
+		if err := http.Serve(s.Listener, h2c.NewHandler(s, &http2.Server{})); err != http.ErrServerClosed {
 			log.Printf("Unable to listen and serve: %v", err)
 		}
 	}()
@@ -99,6 +112,16 @@ func (s *Server) ServerURL() string {
 	return fmt.Sprintf("http://%s", s.Listener.Addr().String())
 }
 
+// ServeHTTP routes gRPC requests to the channelz service and all other
+// requests to the monitoring endpoints
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if rest.IsGRPCRequest(r) {
+		s.channelz.ServeHTTP(w, r)
+		return
+	}
+	s.mux.ServeHTTP(w, r)
+}
+
 // Shutdown stops the server. There is a 2 second timeout.
 func (s *Server) Shutdown() error {
 	s.Listener.Close()
@@ -120,8 +143,25 @@ func (s *Server) SetStatus(httpStatus int) {
 	atomic.StoreInt32(s.healthStatus, int32(httpStatus))
 }
 
+// SetHealthCheck sets a function that determines the health status. When set
+// the status set by SetStatus is ignored and the health status is
+// http.StatusOK when the function returns true and
+// http.StatusServiceUnavailable otherwise. Use this to make the health status
+// follow the gRPC server, ie SetHealthCheck(grpcServer.Serving)
+func (s *Server) SetHealthCheck(check func() bool) {
+	s.healthCheck.Store(check)
+}
+
 // healthzHandler responds to health requests. When the node is available it
 // returns 200, 503 otherwise.
 func (s *Server) healthzHandler(w http.ResponseWriter, r *http.Request) {
+	if check, ok := s.healthCheck.Load().(func() bool); ok && check != nil {
+		if check() {
+			w.WriteHeader(http.StatusOK)
+			return
+		}
+		w.WriteHeader(http.StatusServiceUnavailable)
+		return
+	}
 	w.WriteHeader(int(atomic.LoadInt32(s.healthStatus)))
 }
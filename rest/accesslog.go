@@ -0,0 +1,165 @@
+package rest
+
+//
+//Copyright 2018 Telenor Digital AS
+//
+//Licensed under the Apache License, Version 2.0 (the "License");
+//you may not use this file except in compliance with the License.
+//You may obtain a copy of the License at
+//
+//http://www.apache.org/licenses/LICENSE-2.0
+//
+//Unless required by applicable law or agreed to in writing, software
+//distributed under the License is distributed on an "AS IS" BASIS,
+//WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//See the License for the specific language governing permissions and
+//limitations under the License.
+//
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"io"
+	"log"
+	"math/rand"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// AccessLogRecord is a single structured access log record. The gRPC access
+// logs in the grpcutil package use the same record so HTTP and gRPC logs
+// have the same field names.
+type AccessLogRecord struct {
+	Time             time.Time `json:"time"`
+	Protocol         string    `json:"protocol"`                    // http or grpc
+	Method           string    `json:"method"`                      // HTTP method or full gRPC method name
+	Path             string    `json:"path,omitempty"`              // HTTP request path
+	Peer             string    `json:"peer"`                        // Remote address
+	Principal        string    `json:"principal,omitempty"`         // Authenticated user or service
+	Status           string    `json:"status"`                      // HTTP status code or gRPC status code name
+	DurationMs       float64   `json:"duration_ms"`                 // Time spent handling the request
+	RequestID        string    `json:"request_id,omitempty"`        // Request ID if set
+	MessagesReceived int       `json:"messages_received,omitempty"` // Messages received on gRPC streams
+	MessagesSent     int       `json:"messages_sent,omitempty"`     // Messages sent on gRPC streams
+}
+
+// AccessLogConfig is the configuration for access loggers
+type AccessLogConfig struct {
+	SampleRate float64  // Fraction of successful requests that are logged. Zero logs every request.
+	Suppress   []string // HTTP paths or gRPC methods that are never logged, ie health checks
+}
+
+// AccessLogger writes access log records as JSON, one record per line
+type AccessLogger struct {
+	out        io.Writer
+	mutex      *sync.Mutex
+	sampleRate float64
+	suppress   map[string]bool
+}
+
+// NewAccessLogger creates a new access logger that writes to the writer
+func NewAccessLogger(out io.Writer, config AccessLogConfig) *AccessLogger {
+	ret := &AccessLogger{
+		out:        out,
+		mutex:      &sync.Mutex{},
+		sampleRate: config.SampleRate,
+		suppress:   make(map[string]bool),
+	}
+	for _, s := range config.Suppress {
+		ret.suppress[s] = true
+	}
+	return ret
+}
+
+// Enabled returns false if requests for the path or method are suppressed
+func (a *AccessLogger) Enabled(pathOrMethod string) bool {
+	return !a.suppress[pathOrMethod]
+}
+
+// Log writes the record. Successful requests are sampled if the sample rate
+// is set while failed requests are always logged.
+func (a *AccessLogger) Log(record AccessLogRecord, failed bool) {
+	if !failed && a.sampleRate > 0 && rand.Float64() >= a.sampleRate {
+		return
+	}
+	buf, err := json.Marshal(&record)
+	if err != nil {
+		log.Printf("Unable to marshal access log record: %v", err)
+		return
+	}
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	if _, err := a.out.Write(append(buf, '\n')); err != nil {
+		log.Printf("Unable to write access log record: %v", err)
+	}
+}
+
+// statusRecorder records the status code of the response
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+}
+
+func (s *statusRecorder) WriteHeader(status int) {
+	if s.status == 0 {
+		s.status = status
+	}
+	s.ResponseWriter.WriteHeader(status)
+}
+
+func (s *statusRecorder) Write(buf []byte) (int, error) {
+	if s.status == 0 {
+		s.status = http.StatusOK
+	}
+	return s.ResponseWriter.Write(buf)
+}
+
+func (s *statusRecorder) Flush() {
+	if f, ok := s.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// Hijack is required for websockets. Hijacked connections are logged with
+// the 101 (switching protocols) status.
+func (s *statusRecorder) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	h, ok := s.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, errors.New("response writer does not support hijacking")
+	}
+	s.status = http.StatusSwitchingProtocols
+	return h.Hijack()
+}
+
+// AccessLogWrapper logs every request to the access logger. The principal is
+// the basic auth user name and the request ID is taken from the X-Request-Id
+// header. Requests that fail with a 4xx or 5xx status are always logged.
+func AccessLogWrapper(logger *AccessLogger, handlerFunc http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !logger.Enabled(r.URL.Path) {
+			handlerFunc(w, r)
+			return
+		}
+		start := time.Now()
+		rec := &statusRecorder{ResponseWriter: w}
+		handlerFunc(rec, r)
+		if rec.status == 0 {
+			rec.status = http.StatusOK
+		}
+		principal, _, _ := r.BasicAuth()
+		logger.Log(AccessLogRecord{
+			Time:       start,
+			Protocol:   "http",
+			Method:     r.Method,
+			Path:       r.URL.Path,
+			Peer:       r.RemoteAddr,
+			Principal:  principal,
+			Status:     strconv.Itoa(rec.status),
+			DurationMs: float64(time.Since(start)) / float64(time.Millisecond),
+			RequestID:  r.Header.Get("X-Request-Id"),
+		}, rec.status >= http.StatusBadRequest)
+	}
+}
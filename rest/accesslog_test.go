@@ -0,0 +1,66 @@
+package rest
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestAccessLogWrapper(t *testing.T) {
+	out := &bytes.Buffer{}
+	logger := NewAccessLogger(out, AccessLogConfig{Suppress: []string{"/health"}})
+	server := httptest.NewServer(AccessLogWrapper(logger, func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/missing" {
+			http.NotFound(w, r)
+			return
+		}
+		w.Write([]byte("Hello"))
+	}))
+	defer server.Close()
+
+	for _, path := range []string{"/hello", "/missing", "/health"} {
+		req, err := http.NewRequest("GET", server.URL+path, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.SetBasicAuth("john", "doe")
+		req.Header.Set("X-Request-Id", "request-1")
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+	}
+
+	lines := strings.Split(strings.TrimSpace(out.String()), "\n")
+	if len(lines) != 2 {
+		t.Fatalf("Expected 2 records, got %d: %s", len(lines), out.String())
+	}
+
+	var record map[string]interface{}
+	if err := json.Unmarshal([]byte(lines[0]), &record); err != nil {
+		t.Fatal(err)
+	}
+	expected := map[string]string{"protocol": "http", "method": "GET", "path": "/hello", "principal": "john", "status": "200", "request_id": "request-1"}
+	for field, value := range expected {
+		if record[field] != value {
+			t.Fatalf("Expected %s for %s, got %v", value, field, record[field])
+		}
+	}
+	for _, field := range []string{"time", "peer", "duration_ms"} {
+		if _, ok := record[field]; !ok {
+			t.Fatalf("Missing field %s", field)
+		}
+	}
+
+	var failed AccessLogRecord
+	if err := json.Unmarshal([]byte(lines[1]), &failed); err != nil {
+		t.Fatal(err)
+	}
+	if failed.Status != "404" {
+		t.Fatalf("Expected 404 status, got %s", failed.Status)
+	}
+}
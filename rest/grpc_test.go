@@ -0,0 +1,38 @@
+package rest
+
+//
+//Copyright 2018 Telenor Digital AS
+//
+//Licensed under the Apache License, Version 2.0 (the "License");
+//you may not use this file except in compliance with the License.
+//You may obtain a copy of the License at
+//
+//http://www.apache.org/licenses/LICENSE-2.0
+//
+//Unless required by applicable law or agreed to in writing, software
+//distributed under the License is distributed on an "AS IS" BASIS,
+//WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//See the License for the specific language governing permissions and
+//limitations under the License.
+//
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestIsGRPCRequest(t *testing.T) {
+	r := httptest.NewRequest(http.MethodPost, "/test.Service/Get", nil)
+	r.Header.Set("Content-Type", "application/grpc+proto")
+	if IsGRPCRequest(r) {
+		t.Fatal("HTTP/1 requests aren't gRPC requests")
+	}
+	r.ProtoMajor = 2
+	if !IsGRPCRequest(r) {
+		t.Fatal("Expected a gRPC request")
+	}
+	r.Header.Set("Content-Type", "application/json")
+	if IsGRPCRequest(r) {
+		t.Fatal("JSON requests aren't gRPC requests")
+	}
+}
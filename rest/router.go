@@ -128,6 +128,12 @@ func (r *ParameterRouter) GetHandler(uri string) http.HandlerFunc {
 	return http.NotFound
 }
 
+// ServeHTTP serves the request with the matching handler. This makes the
+// router a http.Handler.
+func (r *ParameterRouter) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	r.GetHandler(req.URL.Path)(w, req)
+}
+
 // GetPathKey is a simple utility function that will return the (string) value
 // for the specified key in the path. If there's an error it will return an
 // empty string.
@@ -18,6 +18,7 @@ package rest
 import (
 	"context"
 	"fmt"
+	"io"
 	"math/rand"
 	"net/http"
 	"net/http/httptest"
@@ -155,3 +156,32 @@ func BenchmarkJustRouting(b *testing.B) {
 		}
 	}
 }
+
+func TestRouterAsHandler(t *testing.T) {
+	router := NewParameterRouter()
+	router.AddRoute("/thing/{id}", func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(GetPathKey("id", r)))
+	})
+
+	server := httptest.NewServer(&router)
+	defer server.Close()
+
+	resp, err := http.Get(server.URL + "/thing/42?param=value")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	buf, _ := io.ReadAll(resp.Body)
+	if resp.StatusCode != http.StatusOK || string(buf) != "42" {
+		t.Fatalf("Expected 200 OK and 42, got %d and %s", resp.StatusCode, string(buf))
+	}
+
+	resp, err = http.Get(server.URL + "/other")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusNotFound {
+		t.Fatalf("Expected 404 for unknown route, got %d", resp.StatusCode)
+	}
+}